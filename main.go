@@ -1,25 +1,56 @@
 package main
 
 import (
+	"archive/tar"
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"io/fs"
+	"math/big"
+	"net"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
+	"os/user"
 	"path"
+	"path/filepath"
 	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	ddbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/nathants/go-dynamolock"
 	"github.com/nathants/go-libsodium"
 	"github.com/nathants/libaws/lib"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
 )
 
 const (
@@ -59,12 +90,63 @@ func bundleNameParts(bundle string) []string {
 	return parts[1:]
 }
 
-func bundleNamesFromMetadata(location string, data []byte) []string {
-	var bundles []string
-	for bundle := range strings.SplitSeq(string(data), "\n") {
-		if bundle != "" {
-			bundleNameParts(bundle)
-			bundles = append(bundles, bundle)
+// a bundle listed in the bundles metadata. size and sha256 describe the
+// encrypted object in s3 and are empty for bundles pushed before they
+// were recorded. kms key is the base64 kms ciphertext of the bundle's
+// data key, and is empty unless the remote uses kms.
+type Bundle struct {
+	Name   string
+	Size   int64
+	Sha256 string
+	KmsKey string
+}
+
+var sha256Pattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// "aaa..bbb 123 ccc [ddd]" => Bundle{"aaa..bbb", 123, "ccc", "ddd"}
+func bundleFromMetadataLine(line string) Bundle {
+	fields := strings.Split(line, " ")
+	bundleNameParts(fields[0])
+	if len(fields) == 1 {
+		return Bundle{Name: fields[0]}
+	}
+	if len(fields) != 3 && len(fields) != 4 {
+		panic("invalid bundles metadata line: " + line)
+	}
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || size < 0 {
+		panic("invalid bundle size: " + line)
+	}
+	if !sha256Pattern.MatchString(fields[2]) {
+		panic("invalid bundle sha256: " + line)
+	}
+	bundle := Bundle{Name: fields[0], Size: size, Sha256: fields[2]}
+	if len(fields) == 4 {
+		_, err := base64.StdEncoding.DecodeString(fields[3])
+		if err != nil || fields[3] == "" {
+			panic("invalid bundle kms key: " + line)
+		}
+		bundle.KmsKey = fields[3]
+	}
+	return bundle
+}
+
+func bundleMetadataLine(bundle Bundle) string {
+	if bundle.Sha256 == "" {
+		return bundle.Name
+	}
+	line := fmt.Sprintf("%s %d %s", bundle.Name, bundle.Size, bundle.Sha256)
+	if bundle.KmsKey != "" {
+		line += " " + bundle.KmsKey
+	}
+	return line
+}
+
+func bundlesFromMetadata(location string, data []byte) []Bundle {
+	var bundles []Bundle
+	for line := range strings.SplitSeq(string(data), "\n") {
+		if line != "" {
+			bundles = append(bundles, bundleFromMetadataLine(line))
 		}
 	}
 	if len(bundles) == 0 {
@@ -73,7 +155,15 @@ func bundleNamesFromMetadata(location string, data []byte) []string {
 	return bundles
 }
 
-func getBundles(bucket, s3Key string) []string {
+func bundlesMetadata(bundles []Bundle) []byte {
+	var lines []string
+	for _, bundle := range bundles {
+		lines = append(lines, bundleMetadataLine(bundle))
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+func getBundles(bucket, s3Key string) []Bundle {
 	if s3Key == "" {
 		return nil
 	}
@@ -91,422 +181,3069 @@ func getBundles(bucket, s3Key string) []string {
 	if err != nil {
 		panic(fmt.Errorf("failed to read bundles metadata %s: %w", location, err))
 	}
-	return bundleNamesFromMetadata(location, data)
-}
-
-// git helper capabilities
-func capabilities() {
-	fmt.Println("push")
-	fmt.Println("fetch")
-	fmt.Println("")
-}
-
-type RepoMeta struct {
-	BundlesS3Key string `json:"bundles" dynamodbav:"bundles"`
-	Branch       string `json:"branch" dynamodbav:"branch"`
+	return bundlesFromMetadata(location, data)
 }
 
-func refBranch(ref string) string {
-	branch, ok := strings.CutPrefix(ref, "refs/heads/")
-	if !ok {
-		panic("ref is not a branch: " + ref)
+// size and hex sha256 of a file
+func fileSha256(file string) (int64, string) {
+	f, err := os.Open(file)
+	if err != nil {
+		panic(err)
 	}
-	if branch == "" || strings.Contains(branch, "/") {
-		panic("branch names cannot be empty or contain slashes: " + branch)
+	defer func() { _ = f.Close() }()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		panic(err)
 	}
-	return branch
+	return size, hex.EncodeToString(h.Sum(nil))
 }
 
-func gitBranchContains(branch, hash string) (bool, bool) {
-	cmd := exec.Command("git", "merge-base", "--is-ancestor", hash, branch)
-	err := cmd.Run()
-	if err == nil {
-		return true, true
+// download an encrypted bundle to a file, verifying size and sha256
+// when they were recorded at push time
+func getBundle(bucket, prefix string, bundle Bundle, file string) {
+	location := "s3://" + bucket + "/" + prefix + "/" + bundle.Name
+	fmt.Fprintln(os.Stderr, "get "+location)
+	out, err := lib.S3Client().GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(prefix + "/" + bundle.Name),
+	})
+	if err != nil {
+		panic(err)
 	}
-	if exitErr, ok := err.(*exec.ExitError); ok {
-		switch exitErr.ExitCode() {
-		case 1:
-			return false, true
-		case 128:
-			return false, false
-		}
+	f, err := os.Create(file)
+	if err != nil {
+		_ = out.Body.Close()
+		panic(err)
+	}
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, h), out.Body)
+	closeBodyErr := out.Body.Close()
+	closeFileErr := f.Close()
+	if err != nil {
+		panic(err)
+	}
+	if closeBodyErr != nil {
+		panic(closeBodyErr)
+	}
+	if closeFileErr != nil {
+		panic(closeFileErr)
+	}
+	if bundle.Sha256 == "" {
+		fmt.Fprintln(os.Stderr, "no checksum recorded, skipping verification:", location)
+		return
+	}
+	if size != bundle.Size {
+		panic(fmt.Sprintf("bundle size mismatch, object is truncated or was replaced: %s: expected %d bytes, got %d", location, bundle.Size, size))
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if sum != bundle.Sha256 {
+		panic(fmt.Sprintf("bundle sha256 mismatch, object is corrupt or was replaced: %s: expected %s, got %s", location, bundle.Sha256, sum))
 	}
-	panic("failed to run: git merge-base --is-ancestor " + hash + " " + branch)
 }
 
-// git helper push
-func push(table, bucket, prefix, command string) {
-
-	// parse args and assert single branch
-	refs := strings.SplitN(command[len("push "):], ":", 2)
-	localRef := refs[0]
-	remoteRef := refs[1]
-	if strings.HasPrefix(localRef, "+") || strings.HasPrefix(remoteRef, "+") {
-		panic("force push is not allowed")
+// the public keys to encrypt an object to: .publickeys, and when the
+// remote uses kms, a data key wrapped by kms. with kms .publickeys is
+// optional. also returns the wrapped data key and the number of
+// .publickeys recipients.
+func objectRecipients(remotePath, name string) ([][]byte, string, int) {
+	var recipients [][]byte
+	kmsKeyID := remoteOptions(remotePath).Get("kms")
+	_, err := os.Stat(".publickeys")
+	if kmsKeyID == "" || err == nil {
+		recipients = publicKeys()
 	}
-	localBranch := refBranch(localRef)
-	remoteBranch := refBranch(remoteRef)
-	if localBranch != remoteBranch {
-		panic(fmt.Sprintf("local branch is different from remote branch, %s != %s", localBranch, remoteBranch))
+	if kmsKeyID == "" {
+		checkRecipients(recipients)
 	}
-	branch := localBranch
+	recipientCount := len(recipients)
+	var kmsKey string
+	if kmsKeyID != "" {
+		var dataPublicKey []byte
+		dataPublicKey, kmsKey = kmsDataKey(kmsKeyID, name)
+		recipients = append(recipients, dataPublicKey)
+	}
+	return recipients, kmsKey, recipientCount
+}
 
-	// fetch and lock remote bundles, defering unlock
-	fmt.Fprintln(os.Stderr, "get dynamodb://"+table+"/"+bucket+"/"+prefix)
-	unlock, _, repoMeta, err := dynamolock.Lock[RepoMeta](context.Background(), &dynamolock.LockInput{
-		Table:             table,
-		ID:                bucket + "/" + prefix,
-		HeartbeatMaxAge:   10 * time.Second,
-		HeartbeatInterval: 1 * time.Second,
-	})
+// pack a commit and its tree, without its history
+func gitPackCommit(hash, file string) {
+	objects := gitOut("rev-list", "--objects", "-1", hash)
+	f, err := os.Create(file)
 	if err != nil {
 		panic(err)
 	}
-	if repoMeta == nil {
-		repoMeta = &RepoMeta{}
+	var stderr bytes.Buffer
+	cmd := exec.Command("git", "pack-objects", "--stdout")
+	cmd.Stdin = strings.NewReader(objects)
+	cmd.Stdout = f
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	closeErr := f.Close()
+	if err != nil {
+		panic(fmt.Errorf("git pack-objects failed: %w: %s", err, stderr.String()))
 	}
-	unlocked := false
-	defer func() {
-		if !unlocked {
-			err := unlock(context.Background(), repoMeta)
-			if err != nil {
-				panic(err)
-			}
-			fmt.Fprintln(os.Stderr, "defer unlock put dynamodb://"+table+"/"+bucket+"/"+prefix, repoMeta)
-		}
-	}()
-	bundles := getBundles(bucket, repoMeta.BundlesS3Key)
-
-	if repoMeta.Branch != "" {
-		// assert local branch is the same as remote
-		if branch != repoMeta.Branch {
-			panic(fmt.Sprintf("you cannot have multiple branches in a remote, %s != %s", branch, repoMeta.Branch))
-		}
-	} else {
-		// or set remote branch if it doesn't yet exist
-		repoMeta.Branch = branch
+	if closeErr != nil {
+		panic(closeErr)
 	}
+}
 
-	// find latest local hash
-	var stdout bytes.Buffer
-	cmd := exec.Command("git", "log", "--format=%H", "-1", branch)
-	cmd.Stdout = &stdout
-	err = cmd.Run()
+// index a checkpoint pack and mark its commit shallow, since its
+// parents are missing
+func gitUnpackCheckpoint(file, hash string) {
+	f, err := os.Open(file)
 	if err != nil {
 		panic(err)
 	}
-	hash := strings.Trim(stdout.String(), "\n")
-
-	// if remote has data and latest hash equals local hash, there is nothing to push
-	if len(bundles) > 0 && hashEnd(last(bundles)) == hash {
-		fmt.Println()
-		return
+	defer func() { _ = f.Close() }()
+	var stderr bytes.Buffer
+	cmd := exec.Command("git", "index-pack", "--stdin")
+	cmd.Stdin = f
+	cmd.Stdout = io.Discard
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err != nil {
+		panic(fmt.Errorf("git index-pack failed: %w: %s", err, stderr.String()))
 	}
+	gitAddShallow(hash)
+}
 
-	// if remote has data and latest hash is unknown locally, we need to pull before pushing
-	if len(bundles) > 0 {
-		hashRemote := hashEnd(last(bundles))
-		contains, _ := gitBranchContains(branch, hashRemote)
-		if !contains {
-			panic("remote has new commits, pull before pushing")
-		}
+// add a commit to the shallow file. like git, the file is rewritten
+// through its lock file, and keeps its mode or is created with the
+// default mode.
+func gitAddShallow(hash string) {
+	file := gitShallowFile()
+	lock := file + ".lock"
+	mode := fs.FileMode(0o666)
+	info, err := os.Stat(file)
+	if err == nil {
+		mode = info.Mode().Perm()
+	} else if !os.IsNotExist(err) {
+		panic(err)
 	}
-
-	// create tempdir and defer cleanup
-	tempdir, err := os.MkdirTemp("/tmp", tempdirPrefix)
+	f, err := os.OpenFile(lock, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		panic(fmt.Errorf("failed to lock shallow file: %w", err))
+	}
+	defer func() { _ = os.Remove(lock) }()
+	shallow := gitShallowCommits()
+	if slices.Contains(shallow, hash) {
+		_ = f.Close()
+		return
+	}
+	_, err = f.WriteString(strings.Join(append(shallow, hash), "\n") + "\n")
+	closeErr := f.Close()
 	if err != nil {
 		panic(err)
 	}
-	defer func() { _ = os.RemoveAll(tempdir) }()
-
-	// setup bundle name and bundle target. a new remote bundles all
-	// commits. an existing remote bundles all commits since the last
-	// bundle in remote.
-	bundleTarget := branch
-	bundleName := zeroHash + ".." + hash
-	if len(hash) == 64 {
-		bundleName = zeroHash256 + ".." + hash
+	if closeErr != nil {
+		panic(closeErr)
 	}
-	if len(bundles) > 0 {
-		bundleTarget = hashEnd(last(bundles)) + ".." + branch
-		bundleName = hashEnd(last(bundles)) + ".." + hash
-	} else {
-		cmd := exec.Command("git", "log", "--format=\"%H%d\"", hash)
-		var stdout bytes.Buffer
-		cmd.Stdout = &stdout
-		err := cmd.Run()
+	if info != nil {
+		err = os.Chmod(lock, mode)
 		if err != nil {
-			panic("failed to run: git log --format=\"%H%d\" " + hash)
-		}
-		if strings.Contains(stdout.String(), "grafted") {
-			panic("grafted repos, those created with `git clone --depth=n`, cannot be used. fetch history then try again: git fetch --unshallow")
+			panic(err)
 		}
 	}
-
-	// create bundle
-	bundleFile := tempdir + "/" + bundleName
-	fmt.Fprintln(os.Stderr, "git bundle:", path.Base(bundleFile))
-	cmd = exec.Command("git", "bundle", "create", bundleFile, bundleTarget)
-	var bundleStdout bytes.Buffer
-	var bundleStderr bytes.Buffer
-	cmd.Stderr = &bundleStderr
-	cmd.Stdout = &bundleStdout
-	err = cmd.Run()
+	err = os.Rename(lock, file)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, bundleStderr.String())
-		fmt.Fprintln(os.Stderr, bundleStdout.String())
 		panic(err)
 	}
+}
 
-	// encrypt
-	bundleFileEncrypted := bundleFile + ".encrypted"
-	r, err := os.Open(bundleFile)
-	if err != nil {
+// the file listing the commits whose parents a shallow repo lacks
+func gitShallowFile() string {
+	return strings.TrimSpace(gitOut("rev-parse", "--git-path", "shallow"))
+}
+
+// the shallow commits of the local repo, empty unless it is shallow
+func gitShallowCommits() []string {
+	data, err := os.ReadFile(gitShallowFile())
+	if err != nil && !os.IsNotExist(err) {
 		panic(err)
 	}
-	w, err := os.Create(bundleFileEncrypted)
-	if err != nil {
-		panic(err)
+	return strings.Fields(string(data))
+}
+
+// a push from a shallow repo is complete only when the new commits do
+// not reach past the shallow boundary, ie every parent they need is
+// the remote tip or its ancestor
+func checkShallowPush(hashRemote, ref string) {
+	shallow := gitShallowCommits()
+	if len(shallow) == 0 {
+		return
+	}
+	for _, hash := range strings.Fields(gitOut("rev-list", ref, "^"+hashRemote)) {
+		if slices.Contains(shallow, hash) {
+			panic("commits to push reach past the shallow boundary at " + hash + ", fetch history then try again: git fetch --unshallow")
+		}
 	}
-	err = libsodium.StreamEncryptRecipients(publicKeys(), r, w)
+}
+
+// pack and encrypt a checkpoint of a local commit, returning it and its
+// encrypted file
+func packCheckpoint(remotePath, hash, tempdir string) (*Checkpoint, string) {
+	checkpoint := &Checkpoint{Hash: hash}
+	name := checkpoint.bundle().Name
+	file := path.Join(tempdir, name)
+	fmt.Fprintln(os.Stderr, "git pack:", name)
+	gitPackCommit(hash, file)
+	recipients, kmsKey, _ := objectRecipients(remotePath, name)
+	encryptFile(recipients, file, file+".encrypted")
+	checkpoint.KmsKey = kmsKey
+	checkpoint.Size, checkpoint.Sha256 = fileSha256(file + ".encrypted")
+	return checkpoint, file + ".encrypted"
+}
+
+// put a checkpoint of the remote tip from a local clone that has it
+func checkpoint(remotePath string) {
+	bucket, table, prefix := parseRemote(remotePath)
+	root := strings.TrimSpace(gitOut("rev-parse", "--show-toplevel"))
+	err := os.Chdir(root)
 	if err != nil {
 		panic(err)
 	}
-	err = r.Close()
+	unlock, update, repoMeta := lockRemote(table, bucket, prefix)
+	defer func() {
+		err := unlock(context.Background(), repoMeta)
+		if err != nil {
+			panic(err)
+		}
+	}()
+	if repoMeta.BundlesS3Key == "" {
+		panic("remote not found: " + remotePath)
+	}
+	repoMeta.checkWritable(remotePath)
+	tip := hashEnd(last(getBundles(bucket, repoMeta.BundlesS3Key)).Name)
+	if repoMeta.Checkpoint != nil && repoMeta.Checkpoint.Hash == tip {
+		fmt.Fprintln(os.Stderr, "checkpoint up to date:", tip)
+		return
+	}
+	if !gitHasCommit(tip) {
+		panic("remote tip " + tip + " is not in the local repo, fetch before creating a checkpoint")
+	}
+	tempdir, err := os.MkdirTemp("/tmp", tempdirPrefix)
 	if err != nil {
 		panic(err)
 	}
-	err = w.Close()
+	defer func() { _ = os.RemoveAll(tempdir) }()
+	oldCheckpoint := repoMeta.Checkpoint
+	newCheckpoint, file := packCheckpoint(remotePath, tip, tempdir)
+	putBundle(bucket, prefix+"/"+newCheckpoint.bundle().Name, file, newCheckpoint.Sha256)
+	repoMeta.Checkpoint = newCheckpoint
+	err = update(context.Background(), repoMeta)
 	if err != nil {
 		panic(err)
 	}
+	fmt.Fprintln(os.Stderr, "put dynamodb://"+table+"/"+bucket+"/"+prefix, repoMeta)
+	if oldCheckpoint != nil {
+		s3Delete(bucket, prefix+"/"+oldCheckpoint.bundle().Name)
+	}
+	fmt.Println("checkpoint", tip)
+}
 
-	// put bundle to s3
-	f, err := os.Open(bundleFileEncrypted)
+// put an encrypted bundle to s3, with its sha256 checked by s3 when
+// one is recorded
+func putBundle(bucket, key, file, sum string) {
+	f, err := os.Open(file)
 	if err != nil {
 		panic(err)
 	}
-	fmt.Fprintln(os.Stderr, "put s3://"+bucket+"/"+prefix+"/"+bundleName)
-	_, err = lib.S3Client().PutObject(context.Background(), &s3.PutObjectInput{
+	defer func() { _ = f.Close() }()
+	input := &s3.PutObjectInput{
 		Bucket: aws.String(bucket),
-		Key:    aws.String(prefix + "/" + bundleName),
+		Key:    aws.String(key),
 		Body:   f,
-	})
+	}
+	if sum != "" {
+		sumBytes, err := hex.DecodeString(sum)
+		if err != nil {
+			panic(err)
+		}
+		input.ChecksumSHA256 = aws.String(base64.StdEncoding.EncodeToString(sumBytes))
+	}
+	fmt.Fprintln(os.Stderr, "put s3://"+bucket+"/"+key)
+	_, err = lib.S3Client().PutObject(context.Background(), input)
 	if err != nil {
 		panic(err)
 	}
+}
 
-	// put bundles metadata to s3 and set key in metadata
-	bundles = append(bundles, bundleName)
-	bundleData := []byte(strings.Join(bundles, "\n"))
-	oldBundlesS3Key := repoMeta.BundlesS3Key
-	repoMeta.BundlesS3Key = prefix + "/" + "bundles_" + hash
-	fmt.Fprintln(os.Stderr, "put s3://"+bucket+"/"+repoMeta.BundlesS3Key)
-	_, err = lib.S3Client().PutObject(context.Background(), &s3.PutObjectInput{
+// put bundles metadata to s3
+func putBundles(bucket, key string, bundles []Bundle) {
+	fmt.Fprintln(os.Stderr, "put s3://"+bucket+"/"+key)
+	_, err := lib.S3Client().PutObject(context.Background(), &s3.PutObjectInput{
 		Bucket: aws.String(bucket),
-		Key:    aws.String(repoMeta.BundlesS3Key),
-		Body:   bytes.NewReader(bundleData),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(bundlesMetadata(bundles)),
 	})
 	if err != nil {
 		panic(err)
 	}
+}
 
-	err = unlock(context.Background(), repoMeta)
-	if err != nil {
-		panic(err)
-	}
-	fmt.Fprintln(os.Stderr, "put dynamodb://"+table+"/"+bucket+"/"+prefix, repoMeta)
-	unlocked = true
+// git helper capabilities
+func capabilities() {
+	fmt.Println("push")
+	fmt.Println("fetch")
+	fmt.Println("option")
+	fmt.Println("")
+}
 
-	// delete previous bundles metadata when a new one is written
-	if oldBundlesS3Key != repoMeta.BundlesS3Key && oldBundlesS3Key != "" {
-		_, err = lib.S3Client().DeleteObject(context.Background(), &s3.DeleteObjectInput{
-			Bucket: aws.String(bucket),
-			Key:    aws.String(oldBundlesS3Key),
-		})
-		if err != nil {
-			panic(err)
-		}
-	}
+// the depth git sends for fetch --unshallow
+const unshallowDepth = 2147483647
 
-	// communicate with git caller
-	fmt.Println("ok", localRef)
-	fmt.Println("")
+// options git sets on the helper
+type helperOptions struct {
+	depth int
 }
 
-func secretKey(remotePath string) []byte {
-	// Check for direct key in env var
-	env := os.Getenv("GIT_REMOTE_AWS_SECRETKEY")
-	if env != "" {
-		secretKey, err := hex.DecodeString(strings.TrimSpace(env))
-		if err != nil {
-			panic(fmt.Errorf("GIT_REMOTE_AWS_SECRETKEY is not valid hex: %w", err))
-		}
-		return secretKey
-	}
-	// Check for command to fetch key
-	cmdEnv := os.Getenv("GIT_REMOTE_AWS_SECRETKEY_CMD")
-	if cmdEnv != "" {
-		var cmd *exec.Cmd
-		if remotePath != "" {
-			cmd = exec.Command(cmdEnv, remotePath)
-		} else {
-			cmd = exec.Command(cmdEnv)
-		}
-		var stdout bytes.Buffer
-		var stderr bytes.Buffer
-		cmd.Stdout = &stdout
-		cmd.Stderr = &stderr
-		err := cmd.Run()
-		if err != nil {
-			panic(fmt.Errorf("GIT_REMOTE_AWS_SECRETKEY_CMD failed: %w: %s", err, stderr.String()))
+// git helper option, answering ok or unsupported
+func option(options *helperOptions, command string) {
+	name, value, _ := strings.Cut(command[len("option "):], " ")
+	switch name {
+	case "depth":
+		depth, err := strconv.Atoi(value)
+		if err != nil || depth < 0 {
+			fmt.Println("error invalid depth " + value)
+			return
 		}
-		secretKey, err := hex.DecodeString(strings.TrimSpace(stdout.String()))
-		if err != nil {
-			panic(fmt.Errorf("GIT_REMOTE_AWS_SECRETKEY_CMD output is not valid hex: %w", err))
+		// a checkpoint is a single commit, so no depth between it and
+		// full history can be served
+		if depth > 1 && depth != unshallowDepth {
+			fmt.Fprintln(os.Stderr, "depth", depth, "is not supported, use --depth 1 or --unshallow")
+			fmt.Println("error unsupported depth " + value)
+			return
 		}
-		return secretKey
+		options.depth = depth
+		fmt.Println("ok")
+	default:
+		fmt.Println("unsupported")
 	}
-	panic("GIT_REMOTE_AWS_SECRETKEY or GIT_REMOTE_AWS_SECRETKEY_CMD must be set")
 }
 
-func publicKey() [][]byte {
-	env := os.Getenv("GIT_REMOTE_AWS_PUBLICKEY")
-	if env == "" {
-		panic("GIT_REMOTE_AWS_PUBLICKEY must be set")
-	}
-	publicKey, err := hex.DecodeString(strings.TrimSpace(env))
-	if err != nil {
-		panic(fmt.Errorf("GIT_REMOTE_AWS_PUBLICKEY is not valid hex: %w", err))
-	}
-	return [][]byte{publicKey}
+type RepoMeta struct {
+	BundlesS3Key string      `json:"bundles" dynamodbav:"bundles"`
+	Branch       string      `json:"branch" dynamodbav:"branch"`
+	Journal      *Journal    `json:"journal" dynamodbav:"journal"`
+	LockHolder   string      `json:"lock_holder" dynamodbav:"lock_holder"`
+	LockUnix     int64       `json:"lock_unix" dynamodbav:"lock_unix"`
+	Recipients   int         `json:"recipients" dynamodbav:"recipients"`
+	State        string      `json:"state" dynamodbav:"state"`
+	Checkpoint   *Checkpoint `json:"checkpoint" dynamodbav:"checkpoint"`
 }
 
-// git helper fetch
-func fetch(table, bucket, prefix, remotePath, command string) {
+// a shallow snapshot of one commit and its tree without history. fetch
+// with a depth downloads it instead of every bundle before it.
+type Checkpoint struct {
+	Hash   string `json:"hash" dynamodbav:"hash"`
+	Size   int64  `json:"size" dynamodbav:"size"`
+	Sha256 string `json:"sha256" dynamodbav:"sha256"`
+	KmsKey string `json:"kms_key" dynamodbav:"kms_key"`
+}
 
-	// parse args to get branch name
+// the checkpoint as a bundle, for download and decryption
+func (c *Checkpoint) bundle() Bundle {
+	return Bundle{Name: "checkpoint_" + c.Hash, Size: c.Size, Sha256: c.Sha256, KmsKey: c.KmsKey}
+}
+
+// states of a remote that refuse writes. a remote with an empty state
+// is writable.
+const (
+	stateFrozen   = "frozen"
+	stateArchived = "archived"
+)
+
+// refuse to write to a frozen or archived remote
+func (m *RepoMeta) checkWritable(remotePath string) {
+	switch m.State {
+	case "":
+	case stateFrozen:
+		panic("remote is frozen and read-only, unfreeze it with git-remote-aws unfreeze: " + remotePath)
+	default:
+		panic("remote is " + m.State + " and read-only: " + remotePath)
+	}
+}
+
+// a push in progress. it is written to the lock item before any object
+// is uploaded, so if the pusher crashes the next lock holder can finish
+// or roll back the push.
+type Journal struct {
+	Branch          string `json:"branch" dynamodbav:"branch"`
+	BundleS3Key     string `json:"bundle" dynamodbav:"bundle"`
+	BundlesS3Key    string `json:"bundles" dynamodbav:"bundles"`
+	OldBundlesS3Key string `json:"old_bundles" dynamodbav:"old_bundles"`
+	// the bundles a mirror copies before BundleS3Key, deleted with it on
+	// rollback
+	MirrorS3Keys []string `json:"mirror,omitempty" dynamodbav:"mirror,omitempty"`
+	// the checkpoint a push puts after its bundles metadata, and the one
+	// it replaces
+	Checkpoint         *Checkpoint `json:"checkpoint,omitempty" dynamodbav:"checkpoint,omitempty"`
+	CheckpointS3Key    string      `json:"checkpoint_key,omitempty" dynamodbav:"checkpoint_key,omitempty"`
+	OldCheckpointS3Key string      `json:"old_checkpoint_key,omitempty" dynamodbav:"old_checkpoint_key,omitempty"`
+}
+
+func refBranch(ref string) string {
+	branch, ok := strings.CutPrefix(ref, "refs/heads/")
+	if !ok {
+		panic("ref is not a branch: " + ref)
+	}
+	if branch == "" || strings.Contains(branch, "/") {
+		panic("branch names cannot be empty or contain slashes: " + branch)
+	}
+	return branch
+}
+
+// whether a commit exists in the local object database
+func gitHasCommit(hash string) bool {
+	cmd := exec.Command("git", "cat-file", "-e", hash+"^{commit}")
+	err := cmd.Run()
+	if err == nil {
+		return true
+	}
+	if _, ok := err.(*exec.ExitError); ok {
+		return false
+	}
+	panic("failed to run: git cat-file -e " + hash + "^{commit}")
+}
+
+func gitBranchContains(branch, hash string) (bool, bool) {
+	cmd := exec.Command("git", "merge-base", "--is-ancestor", hash, branch)
+	err := cmd.Run()
+	if err == nil {
+		return true, true
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		switch exitErr.ExitCode() {
+		case 1:
+			return false, true
+		case 128:
+			return false, false
+		}
+	}
+	panic("failed to run: git merge-base --is-ancestor " + hash + " " + branch)
+}
+
+// duration from an env var, or a default when it is unset
+func envDuration(name string, defaultValue time.Duration) time.Duration {
+	env := os.Getenv(name)
+	if env == "" {
+		return defaultValue
+	}
+	duration, err := time.ParseDuration(env)
+	if err != nil {
+		panic(fmt.Errorf("%s is not a valid duration: %w", name, err))
+	}
+	return duration
+}
+
+// "user@host pid 123", recorded in the lock item to diagnose contention
+func lockHolder() string {
+	username := "unknown"
+	current, err := user.Current()
+	if err == nil {
+		username = current.Username
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s@%s pid %d", username, hostname, os.Getpid())
+}
+
+// "held by user@host pid 123 since 2022-08-01T00:00:00Z", or "held"
+// when the holder did not record itself
+func lockHeldBy(table, bucket, prefix string) string {
+	repoMeta, err := dynamolock.Read[RepoMeta](context.Background(), table, bucket+"/"+prefix)
+	if err != nil || repoMeta == nil || repoMeta.LockHolder == "" {
+		return "held"
+	}
+	return "held by " + repoMeta.LockHolder + " since " + lockSince(repoMeta.LockUnix)
+}
+
+// when the lock holder took the lock, or unknown when it did not record it
+func lockSince(unix int64) string {
+	if unix == 0 {
+		return "unknown"
+	}
+	return time.Unix(unix, 0).UTC().Format(time.RFC3339)
+}
+
+// whether a lock error is contention with another holder, the only
+// error worth waiting on. anything else, like access denied or a
+// missing table, fails at once, as does reading the lock item.
+func lockContended(table, id string, err error) bool {
+	var conditionFailed *ddbtypes.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return true
+	}
+	locked, _ := lockStatus(table, id)
+	return locked
+}
+
+// lock a remote and read its metadata, recovering any push that was
+// interrupted. the lock is held until unlock is called with the
+// metadata to write. update writes metadata while keeping the lock.
+//
+// when the lock is held, wait up to GIT_REMOTE_AWS_LOCK_WAIT with
+// exponential backoff. lock timing is configured with
+// GIT_REMOTE_AWS_LOCK_MAX_AGE and GIT_REMOTE_AWS_LOCK_HEARTBEAT.
+func lockRemote(table, bucket, prefix string) (func(context.Context, *RepoMeta) error, func(context.Context, *RepoMeta) error, *RepoMeta) {
+	input := &dynamolock.LockInput{
+		Table:             table,
+		ID:                bucket + "/" + prefix,
+		HeartbeatMaxAge:   envDuration("GIT_REMOTE_AWS_LOCK_MAX_AGE", 10*time.Second),
+		HeartbeatInterval: envDuration("GIT_REMOTE_AWS_LOCK_HEARTBEAT", 1*time.Second),
+	}
+	wait := envDuration("GIT_REMOTE_AWS_LOCK_WAIT", 0)
+	start := time.Now()
+	backoff := 1 * time.Second
+	var unlock func(context.Context, *RepoMeta) error
+	var update func(context.Context, *RepoMeta) error
+	var repoMeta *RepoMeta
+	for {
+		var err error
+		fmt.Fprintln(os.Stderr, "get dynamodb://"+table+"/"+bucket+"/"+prefix)
+		unlock, update, repoMeta, err = dynamolock.Lock[RepoMeta](context.Background(), input)
+		if err == nil {
+			break
+		}
+		if !lockContended(table, bucket+"/"+prefix, err) {
+			panic(fmt.Errorf("failed to lock dynamodb://%s/%s/%s: %w", table, bucket, prefix, err))
+		}
+		heldBy := lockHeldBy(table, bucket, prefix)
+		if time.Since(start)+backoff > wait {
+			panic(fmt.Errorf("failed to lock dynamodb://%s/%s/%s, lock %s: %w", table, bucket, prefix, heldBy, err))
+		}
+		fmt.Fprintf(os.Stderr, "waiting for lock %s, retry in %s: %v\n", heldBy, backoff, err)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, 30*time.Second)
+	}
+	if repoMeta == nil {
+		repoMeta = &RepoMeta{}
+	}
+
+	// record the holder, and recover any interrupted push
+	repoMeta.LockHolder = lockHolder()
+	repoMeta.LockUnix = time.Now().Unix()
+	if repoMeta.Journal != nil {
+		recoverPush(bucket, repoMeta)
+	}
+	err := update(context.Background(), repoMeta)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Fprintln(os.Stderr, "put dynamodb://"+table+"/"+bucket+"/"+prefix, repoMeta)
+
+	// clear the holder on unlock
+	unlockAndClear := func(ctx context.Context, repoMeta *RepoMeta) error {
+		repoMeta.LockHolder = ""
+		repoMeta.LockUnix = 0
+		return unlock(ctx, repoMeta)
+	}
+	return unlockAndClear, update, repoMeta
+}
+
+func s3Exists(bucket, key string) bool {
+	_, err := lib.S3Client().HeadObject(context.Background(), &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var notFound *s3types.NotFound
+		if errors.As(err, &notFound) {
+			return false
+		}
+		panic(err)
+	}
+	return true
+}
+
+func s3Delete(bucket, key string) {
+	fmt.Fprintln(os.Stderr, "delete s3://"+bucket+"/"+key)
+	_, err := lib.S3Client().DeleteObject(context.Background(), &s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// whether bundles are the same as old with one or more bundles appended
+func bundlesExtend(old, bundles []Bundle) bool {
+	if len(bundles) <= len(old) {
+		return false
+	}
+	for i := range old {
+		if old[i].Name != bundles[i].Name {
+			return false
+		}
+	}
+	return true
+}
+
+// finish or roll back a push interrupted between writing its journal
+// and unlocking. a push whose uploads both completed and extend the
+// current bundles is committed, otherwise its uploads are deleted.
+// either way the old bundles metadata is deleted once it is replaced.
+// a checkpoint is kept with a committed push when it was put, and the
+// one it replaces is deleted, otherwise it is deleted.
+func recoverPush(bucket string, repoMeta *RepoMeta) {
+	journal := repoMeta.Journal
+	fmt.Fprintln(os.Stderr, "recovering interrupted push:", journal.BundleS3Key)
+	if repoMeta.BundlesS3Key != journal.BundlesS3Key && s3Exists(bucket, journal.BundleS3Key) && s3Exists(bucket, journal.BundlesS3Key) {
+		if bundlesExtend(getBundles(bucket, repoMeta.BundlesS3Key), getBundles(bucket, journal.BundlesS3Key)) {
+			fmt.Fprintln(os.Stderr, "finishing interrupted push:", journal.BundlesS3Key)
+			repoMeta.BundlesS3Key = journal.BundlesS3Key
+			repoMeta.Branch = journal.Branch
+			if journal.Checkpoint != nil && s3Exists(bucket, journal.CheckpointS3Key) {
+				repoMeta.Checkpoint = journal.Checkpoint
+			}
+		}
+	}
+	if journal.Checkpoint != nil {
+		if repoMeta.Checkpoint != nil && repoMeta.Checkpoint.Hash == journal.Checkpoint.Hash {
+			if journal.OldCheckpointS3Key != "" {
+				s3Delete(bucket, journal.OldCheckpointS3Key)
+			}
+		} else {
+			s3Delete(bucket, journal.CheckpointS3Key)
+		}
+	}
+	if repoMeta.BundlesS3Key == journal.BundlesS3Key {
+		if journal.OldBundlesS3Key != "" && journal.OldBundlesS3Key != repoMeta.BundlesS3Key {
+			s3Delete(bucket, journal.OldBundlesS3Key)
+		}
+	} else {
+		fmt.Fprintln(os.Stderr, "rolling back interrupted push:", journal.BundleS3Key)
+		for _, key := range journal.MirrorS3Keys {
+			s3Delete(bucket, key)
+		}
+		s3Delete(bucket, journal.BundleS3Key)
+		s3Delete(bucket, journal.BundlesS3Key)
+	}
+	repoMeta.Journal = nil
+}
+
+// git helper push
+func push(table, bucket, prefix, remotePath, command string) {
+
+	// parse args. the remote side must be a branch. the local side can
+	// be any commit, like a differently named branch, HEAD, or a hash.
+	refs := strings.SplitN(command[len("push "):], ":", 2)
+	localRef := refs[0]
+	remoteRef := refs[1]
+	if strings.HasPrefix(localRef, "+") || strings.HasPrefix(remoteRef, "+") {
+		panic("force push is not allowed")
+	}
+	branch := refBranch(remoteRef)
+	if localRef == "" {
+		panic("deleting a remote branch is not allowed, use git-remote-aws rm")
+	}
+
+	// bundle commits that are not a ref, like a hash from a detached
+	// HEAD, through a temporary ref
+	ref := localRef
+	if !strings.HasPrefix(ref, "refs/") {
+		ref = "refs/git-remote-aws/push"
+		gitOut("update-ref", ref, localRef)
+		defer func() { _ = exec.Command("git", "update-ref", "-d", ref).Run() }()
+	}
+
+	if pushRef(table, bucket, prefix, remotePath, branch, ref) {
+		fmt.Println("ok", remoteRef)
+	}
+	fmt.Println("")
+}
+
+// push the commits of ref to the remote branch as one bundle, returning
+// false when the remote is already at ref
+func pushRef(table, bucket, prefix, remotePath, branch, ref string) bool {
+
+	// fetch and lock remote bundles, defering unlock. repoMeta always
+	// holds what was last written to the lock item, so the deferred
+	// unlock leaves any journal in place for the next lock holder.
+	unlock, update, repoMeta := lockRemote(table, bucket, prefix)
+	unlocked := false
+	defer func() {
+		if !unlocked {
+			err := unlock(context.Background(), repoMeta)
+			if err != nil {
+				panic(err)
+			}
+			fmt.Fprintln(os.Stderr, "defer unlock put dynamodb://"+table+"/"+bucket+"/"+prefix, repoMeta)
+		}
+	}()
+	repoMeta.checkWritable(remotePath)
+	bundles := getBundles(bucket, repoMeta.BundlesS3Key)
+
+	// assert local branch is the same as remote, if remote has a branch
+	if repoMeta.Branch != "" && branch != repoMeta.Branch {
+		panic(fmt.Sprintf("you cannot have multiple branches in a remote, %s != %s", branch, repoMeta.Branch))
+	}
+
+	// find latest local hash
+	var stdout bytes.Buffer
+	cmd := exec.Command("git", "log", "--format=%H", "-1", ref)
+	cmd.Stdout = &stdout
+	err := cmd.Run()
+	if err != nil {
+		panic(err)
+	}
+	hash := strings.Trim(stdout.String(), "\n")
+
+	// if remote has data and latest hash equals local hash, there is nothing to push
+	if len(bundles) > 0 && hashEnd(last(bundles).Name) == hash {
+		return false
+	}
+
+	// if remote has data and latest hash is unknown locally, we need to
+	// pull before pushing. a shallow repo can push when the remote tip is
+	// in its shallow history, since the bundle starts at the remote tip.
+	if len(bundles) > 0 {
+		hashRemote := hashEnd(last(bundles).Name)
+		contains, known := gitBranchContains(ref, hashRemote)
+		if !known && len(gitShallowCommits()) > 0 {
+			panic("remote tip " + hashRemote + " is not in the local shallow history. pull before pushing, or if it is older than the shallow boundary, deepen history: git fetch --deepen=n")
+		}
+		if !contains {
+			panic("remote has new commits, pull before pushing")
+		}
+		checkShallowPush(hashRemote, ref)
+	}
+
+	// create tempdir and defer cleanup
+	tempdir, err := os.MkdirTemp("/tmp", tempdirPrefix)
+	if err != nil {
+		panic(err)
+	}
+	defer func() { _ = os.RemoveAll(tempdir) }()
+
+	// setup bundle name and bundle target. a new remote bundles all
+	// commits. an existing remote bundles all commits since the last
+	// bundle in remote.
+	bundleTarget := ref
+	bundleName := zeroHash + ".." + hash
+	if len(hash) == 64 {
+		bundleName = zeroHash256 + ".." + hash
+	}
+	if len(bundles) > 0 {
+		bundleTarget = hashEnd(last(bundles).Name) + ".." + ref
+		bundleName = hashEnd(last(bundles).Name) + ".." + hash
+	} else {
+		cmd := exec.Command("git", "log", "--format=\"%H%d\"", hash)
+		var stdout bytes.Buffer
+		cmd.Stdout = &stdout
+		err := cmd.Run()
+		if err != nil {
+			panic("failed to run: git log --format=\"%H%d\" " + hash)
+		}
+		if strings.Contains(stdout.String(), "grafted") {
+			panic("grafted repos, those created with `git clone --depth=n`, cannot be used. fetch history then try again: git fetch --unshallow")
+		}
+	}
+
+	// create bundle
+	bundleFile := tempdir + "/" + bundleName
+	fmt.Fprintln(os.Stderr, "git bundle:", path.Base(bundleFile))
+	cmd = exec.Command("git", "bundle", "create", bundleFile, bundleTarget)
+	var bundleStdout bytes.Buffer
+	var bundleStderr bytes.Buffer
+	cmd.Stderr = &bundleStderr
+	cmd.Stdout = &bundleStdout
+	err = cmd.Run()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, bundleStderr.String())
+		fmt.Fprintln(os.Stderr, bundleStdout.String())
+		panic(err)
+	}
+
+	recipients, kmsKey, recipientCount := objectRecipients(remotePath, bundleName)
+	bundleFileEncrypted := bundleFile + ".encrypted"
+	encryptFile(recipients, bundleFile, bundleFileEncrypted)
+	if os.Getenv("GIT_REMOTE_AWS_PUSH_TEST_DECRYPT") != "" {
+		testDecrypt(bundleSecretKey(remotePath, Bundle{Name: bundleName, KmsKey: kmsKey}), bundleFileEncrypted)
+	}
+
+	// checksum encrypted bundle so fetch can verify it
+	size, sum := fileSha256(bundleFileEncrypted)
+
+	// optionally pack a checkpoint of the new tip for shallow fetches
+	var checkpoint *Checkpoint
+	var checkpointFile string
+	if os.Getenv("GIT_REMOTE_AWS_CHECKPOINT") != "" {
+		checkpoint, checkpointFile = packCheckpoint(remotePath, hash, tempdir)
+	}
+
+	// write journal before uploading anything
+	newBundlesS3Key := prefix + "/" + "bundles_" + hash
+	oldBundlesS3Key := repoMeta.BundlesS3Key
+	repoMeta.Journal = &Journal{
+		Branch:          branch,
+		BundleS3Key:     prefix + "/" + bundleName,
+		BundlesS3Key:    newBundlesS3Key,
+		OldBundlesS3Key: oldBundlesS3Key,
+	}
+	oldCheckpoint := repoMeta.Checkpoint
+	if checkpoint != nil {
+		repoMeta.Journal.Checkpoint = checkpoint
+		repoMeta.Journal.CheckpointS3Key = prefix + "/" + checkpoint.bundle().Name
+		if oldCheckpoint != nil {
+			repoMeta.Journal.OldCheckpointS3Key = prefix + "/" + oldCheckpoint.bundle().Name
+		}
+	}
+	err = update(context.Background(), repoMeta)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Fprintln(os.Stderr, "put dynamodb://"+table+"/"+bucket+"/"+prefix, repoMeta)
+
+	// put bundle to s3
+	putBundle(bucket, prefix+"/"+bundleName, bundleFileEncrypted, sum)
+
+	// put bundles metadata to s3
+	bundles = append(bundles, Bundle{Name: bundleName, Size: size, Sha256: sum, KmsKey: kmsKey})
+	putBundles(bucket, newBundlesS3Key, bundles)
+
+	// put the checkpoint
+	if checkpoint != nil {
+		putBundle(bucket, repoMeta.Journal.CheckpointS3Key, checkpointFile, checkpoint.Sha256)
+		repoMeta.Checkpoint = checkpoint
+	}
+
+	// commit by setting key in metadata, keeping the journal until the
+	// previous bundles metadata is deleted
+	repoMeta.BundlesS3Key = newBundlesS3Key
+	repoMeta.Branch = branch
+	repoMeta.Recipients = recipientCount
+	err = update(context.Background(), repoMeta)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Fprintln(os.Stderr, "put dynamodb://"+table+"/"+bucket+"/"+prefix, repoMeta)
+
+	// delete previous bundles metadata when a new one is written
+	if oldBundlesS3Key != repoMeta.BundlesS3Key && oldBundlesS3Key != "" {
+		s3Delete(bucket, oldBundlesS3Key)
+	}
+	if repoMeta.Journal.OldCheckpointS3Key != "" {
+		s3Delete(bucket, repoMeta.Journal.OldCheckpointS3Key)
+	}
+
+	repoMeta.Journal = nil
+	err = unlock(context.Background(), repoMeta)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Fprintln(os.Stderr, "put dynamodb://"+table+"/"+bucket+"/"+prefix, repoMeta)
+	unlocked = true
+	return true
+}
+
+// secret keys resolved by this process, by remote path
+var secretKeys = map[string][]byte{}
+
+// resolve the secret key once per process. keys from a command or a key
+// file are cached by the agent, if one is running, so they are not
+// resolved again by every git invocation.
+func secretKey(remotePath string) []byte {
+	secretKey, ok := secretKeys[remotePath]
+	if ok {
+		return secretKey
+	}
+	id := secretKeyAgentID(remotePath)
+	if id == "" {
+		secretKey = resolveSecretKey(remotePath)
+	} else {
+		secretKey, ok = agentGet(id)
+		if !ok {
+			secretKey = resolveSecretKey(remotePath)
+			agentPut(id, secretKey)
+		}
+	}
+	secretKeys[remotePath] = secretKey
+	return secretKey
+}
+
+// where the secret key comes from, in order of precedence, and the
+// command or file it is read from. the kind is empty when no secret key
+// is configured.
+func secretKeySource() (string, string) {
+	if os.Getenv("GIT_REMOTE_AWS_SECRETKEY") != "" {
+		return "env", ""
+	}
+	cmdEnv := os.Getenv("GIT_REMOTE_AWS_SECRETKEY_CMD")
+	if cmdEnv != "" {
+		return "cmd", cmdEnv
+	}
+	_, ok := readKeyFile()
+	if ok {
+		return "keyfile", keyFilePath()
+	}
+	ageEnv := os.Getenv("GIT_REMOTE_AWS_AGE_IDENTITY")
+	if ageEnv != "" {
+		return "age", ageEnv
+	}
+	sshEnv := os.Getenv("GIT_REMOTE_AWS_SSH_KEY")
+	if sshEnv != "" {
+		return "ssh", sshEnv
+	}
+	home, err := os.UserHomeDir()
+	if err == nil {
+		file := path.Join(home, ".ssh", "id_ed25519")
+		_, err = os.Stat(file)
+		if err == nil {
+			return "ssh", file
+		}
+	}
+	return "", ""
+}
+
+// the agent cache id of the secret key, or empty when it comes from
+// GIT_REMOTE_AWS_SECRETKEY and caching is pointless. the id is hashed
+// so it is a single token in the agent protocol.
+func secretKeyAgentID(remotePath string) string {
+	kind, source := secretKeySource()
+	if kind == "env" || kind == "" {
+		return ""
+	}
+	id := kind + ":" + source
+	if kind == "cmd" {
+		id += ":" + remotePath
+	}
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
+
+func resolveSecretKey(remotePath string) []byte {
+	kind, source := secretKeySource()
+	switch kind {
+	case "env":
+		env := os.Getenv("GIT_REMOTE_AWS_SECRETKEY")
+		secretKey, err := hex.DecodeString(strings.TrimSpace(env))
+		if err != nil {
+			panic(fmt.Errorf("GIT_REMOTE_AWS_SECRETKEY is not valid hex: %w", err))
+		}
+		return secretKey
+	case "cmd":
+		var cmd *exec.Cmd
+		if remotePath != "" {
+			cmd = exec.Command(source, remotePath)
+		} else {
+			cmd = exec.Command(source)
+		}
+		var stdout bytes.Buffer
+		var stderr bytes.Buffer
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		err := cmd.Run()
+		if err != nil {
+			panic(fmt.Errorf("GIT_REMOTE_AWS_SECRETKEY_CMD failed: %w: %s", err, stderr.String()))
+		}
+		secretKey, err := hex.DecodeString(strings.TrimSpace(stdout.String()))
+		if err != nil {
+			panic(fmt.Errorf("GIT_REMOTE_AWS_SECRETKEY_CMD output is not valid hex: %w", err))
+		}
+		return secretKey
+	case "keyfile":
+		keyFile, _ := readKeyFile()
+		return decryptKeyFile(keyFile, readPassphrase("passphrase for "+source+": ", false))
+	case "age":
+		return ageSecretKey(source)
+	case "ssh":
+		return sshSecretKey(source)
+	default:
+		panic("GIT_REMOTE_AWS_SECRETKEY or GIT_REMOTE_AWS_SECRETKEY_CMD must be set, or a key file must exist at " + keyFilePath() + ", or GIT_REMOTE_AWS_AGE_IDENTITY or GIT_REMOTE_AWS_SSH_KEY must be set, or ~/.ssh/id_ed25519 must exist")
+	}
+}
+
+// the x25519 secret key of an age identity file. the first identity in
+// the file is used, comment lines start with #.
+func ageSecretKey(file string) []byte {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		panic(err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hrp, secretKey, err := bech32Decode(line)
+		if err != nil {
+			panic(fmt.Errorf("malformed age identity %s: %w", file, err))
+		}
+		if hrp != "age-secret-key-" || len(secretKey) != curve25519.ScalarSize {
+			panic("malformed age identity " + file + ": not an X25519 identity")
+		}
+		return secretKey
+	}
+	panic("no identity in age identity file " + file)
+}
+
+// the x25519 secret key of an openssh ed25519 private key, the same
+// conversion libsodium does in crypto_sign_ed25519_sk_to_curve25519
+func sshSecretKey(file string) []byte {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		panic(err)
+	}
+	key, err := ssh.ParseRawPrivateKey(data)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		key, err = ssh.ParseRawPrivateKeyWithPassphrase(data, readPassphrase("passphrase for "+file+": ", false))
+	}
+	if err != nil {
+		panic(fmt.Errorf("failed to read ssh key %s: %w", file, err))
+	}
+	privateKey, ok := key.(*ed25519.PrivateKey)
+	if !ok {
+		panic("ssh key " + file + " is not ssh-ed25519")
+	}
+	return ed25519SecretKeyToX25519(*privateKey)
+}
+
+func ed25519SecretKeyToX25519(privateKey ed25519.PrivateKey) []byte {
+	sum := sha512.Sum512(privateKey.Seed())
+	secretKey := sum[:curve25519.ScalarSize]
+	secretKey[0] &= 248
+	secretKey[31] &= 127
+	secretKey[31] |= 64
+	return secretKey
+}
+
+// the x25519 public key of an ed25519 public key, the birational map
+// u = (1 + y) / (1 - y) from edwards25519 to curve25519
+func ed25519PublicKeyToX25519(publicKey ed25519.PublicKey) ([]byte, error) {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("ed25519 public key is %d bytes", len(publicKey))
+	}
+	p := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+	le := make([]byte, len(publicKey))
+	for i, b := range publicKey {
+		le[len(le)-1-i] = b
+	}
+	le[0] &= 0x7f // drop the sign bit of x
+	y := new(big.Int).SetBytes(le)
+	if y.Cmp(p) >= 0 {
+		return nil, fmt.Errorf("invalid ed25519 public key")
+	}
+	denominator := new(big.Int).Sub(big.NewInt(1), y)
+	denominator.Mod(denominator, p)
+	if denominator.Sign() == 0 {
+		return nil, fmt.Errorf("invalid ed25519 public key")
+	}
+	u := new(big.Int).Add(big.NewInt(1), y)
+	u.Mul(u, denominator.ModInverse(denominator, p))
+	u.Mod(u, p)
+	be := u.FillBytes(make([]byte, curve25519.PointSize))
+	out := make([]byte, len(be))
+	for i, b := range be {
+		out[len(out)-1-i] = b
+	}
+	return out, nil
+}
+
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+func bech32Polymod(values []byte) uint32 {
+	generator := []uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i, g := range generator {
+			if (top>>uint(i))&1 == 1 {
+				chk ^= g
+			}
+		}
+	}
+	return chk
+}
+
+// decode a bech32 string, as used by age keys, into its lowercase human
+// readable part and data bytes
+func bech32Decode(s string) (string, []byte, error) {
+	if strings.ToLower(s) != s && strings.ToUpper(s) != s {
+		return "", nil, fmt.Errorf("mixed case bech32")
+	}
+	s = strings.ToLower(s)
+	pos := strings.LastIndex(s, "1")
+	if pos < 1 || pos+7 > len(s) {
+		return "", nil, fmt.Errorf("malformed bech32")
+	}
+	hrp := s[:pos]
+	var values []byte
+	for _, c := range hrp {
+		values = append(values, byte(c>>5))
+	}
+	values = append(values, 0)
+	for _, c := range hrp {
+		values = append(values, byte(c&31))
+	}
+	var data []byte
+	for _, c := range s[pos+1:] {
+		i := strings.IndexRune(bech32Charset, c)
+		if i == -1 {
+			return "", nil, fmt.Errorf("invalid bech32 character %q", c)
+		}
+		data = append(data, byte(i))
+	}
+	if bech32Polymod(append(values, data...)) != 1 {
+		return "", nil, fmt.Errorf("invalid bech32 checksum")
+	}
+	data = data[:len(data)-6]
+	// regroup 5 bit values into bytes
+	var out []byte
+	acc := 0
+	bits := 0
+	for _, v := range data {
+		acc = acc<<5 | int(v)
+		bits += 5
+		if bits >= 8 {
+			bits -= 8
+			out = append(out, byte(acc>>uint(bits)))
+		}
+	}
+	if bits >= 5 || acc&(1<<uint(bits)-1) != 0 {
+		return "", nil, fmt.Errorf("invalid bech32 padding")
+	}
+	return hrp, out, nil
+}
+
+// parse a recipient from .publickeys: a hex libsodium box public key, an
+// ssh-ed25519 authorized key, or an age1 recipient
+func parsePublicKey(line string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(line, "ssh-"):
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return nil, err
+		}
+		if key.Type() != ssh.KeyAlgoED25519 {
+			return nil, fmt.Errorf("unsupported ssh key type %s, only ssh-ed25519 is supported", key.Type())
+		}
+		cryptoKey, ok := key.(ssh.CryptoPublicKey)
+		if !ok {
+			return nil, fmt.Errorf("unsupported ssh key")
+		}
+		publicKey, ok := cryptoKey.CryptoPublicKey().(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("unsupported ssh key")
+		}
+		return ed25519PublicKeyToX25519(publicKey)
+	case strings.HasPrefix(line, "age1"):
+		hrp, publicKey, err := bech32Decode(line)
+		if err != nil {
+			return nil, err
+		}
+		if hrp != "age" || len(publicKey) != curve25519.PointSize {
+			return nil, fmt.Errorf("not an X25519 age recipient")
+		}
+		return publicKey, nil
+	default:
+		publicKey, err := hex.DecodeString(line)
+		if err != nil {
+			return nil, fmt.Errorf("not a hex public key, ssh-ed25519 key, or age1 recipient")
+		}
+		if len(publicKey) != curve25519.PointSize {
+			return nil, fmt.Errorf("hex public key is %d bytes, expected %d", len(publicKey), curve25519.PointSize)
+		}
+		return publicKey, nil
+	}
+}
+
+// the local public key, from GIT_REMOTE_AWS_PUBLICKEY, or of the secret
+// key that decrypts
+func publicKey() [][]byte {
+	env := os.Getenv("GIT_REMOTE_AWS_PUBLICKEY")
+	if env == "" {
+		if hasSecretKey() {
+			return [][]byte{secretPublicKey()}
+		}
+		panic("GIT_REMOTE_AWS_PUBLICKEY must be set, or a key file must exist at " + keyFilePath() + ", or a secret key must be configured")
+	}
+	publicKey, err := hex.DecodeString(strings.TrimSpace(env))
+	if err != nil {
+		panic(fmt.Errorf("GIT_REMOTE_AWS_PUBLICKEY is not valid hex: %w", err))
+	}
+	// compare with the secret key only when that costs nothing, so a
+	// command or a key file passphrase is not needed just for this.
+	// whoami resolves the secret key to compare in every case.
+	kind, _ := secretKeySource()
+	switch kind {
+	case "env", "keyfile":
+		warnPublicKeyMismatch(publicKey, secretPublicKey())
+	default:
+		for _, resolved := range secretKeys {
+			warnPublicKeyMismatch(publicKey, derivePublicKey(resolved))
+		}
+	}
+	return [][]byte{publicKey}
+}
+
+// the public key of the secret key that decrypts. a key file stores its
+// public key, so it is not unlocked for this.
+func secretPublicKey() []byte {
+	kind, _ := secretKeySource()
+	if kind == "keyfile" {
+		keyFile, _ := readKeyFile()
+		return keyFile.publicKey()
+	}
+	return derivePublicKey(secretKey(""))
+}
+
+func warnPublicKeyMismatch(publicKey, secretPublicKey []byte) {
+	if !bytes.Equal(publicKey, secretPublicKey) {
+		fmt.Fprintln(os.Stderr, "warning: GIT_REMOTE_AWS_PUBLICKEY", hex.EncodeToString(publicKey), "does not match the public key of the secret key", hex.EncodeToString(secretPublicKey))
+	}
+}
+
+// the box public key of a box secret key
+func derivePublicKey(secretKey []byte) []byte {
+	publicKey, err := curve25519.X25519(secretKey, curve25519.Basepoint)
+	if err != nil {
+		panic(err)
+	}
+	return publicKey
+}
+
+// GIT_REMOTE_AWS_AGENT_SOCK, or a socket in a private directory under
+// XDG_RUNTIME_DIR or /tmp
+func agentSocketPath() string {
+	env := os.Getenv("GIT_REMOTE_AWS_AGENT_SOCK")
+	if env != "" {
+		return env
+	}
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if runtimeDir == "" {
+		runtimeDir = fmt.Sprintf("/tmp/git-remote-aws-%d", os.Getuid())
+	} else {
+		runtimeDir = path.Join(runtimeDir, "git-remote-aws")
+	}
+	return path.Join(runtimeDir, "agent.sock")
+}
+
+// refuse an agent directory or socket another user could have created
+// or could reach. it must be ours, not a symlink, and have no group or
+// other permissions.
+func checkAgentPath(file string, isDir bool) error {
+	info, err := os.Lstat(file)
+	if err != nil {
+		return err
+	}
+	if isDir && !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", file)
+	}
+	if !isDir && info.Mode().Type() != os.ModeSocket {
+		return fmt.Errorf("%s is not a socket", file)
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || int(stat.Uid) != os.Getuid() {
+		return fmt.Errorf("%s is not owned by uid %d", file, os.Getuid())
+	}
+	if info.Mode().Perm()&0o077 != 0 {
+		return fmt.Errorf("%s has group or other permissions %s", file, info.Mode().Perm())
+	}
+	return nil
+}
+
+// the process on the other end of an agent connection must be ours
+func checkAgentPeer(conn net.Conn) error {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return fmt.Errorf("agent connection is not a unix socket")
+	}
+	uid, err := peerUid(unixConn)
+	if err != nil {
+		return err
+	}
+	if uid != os.Getuid() {
+		return fmt.Errorf("agent peer is uid %d, expected %d", uid, os.Getuid())
+	}
+	return nil
+}
+
+// send a one line request to the agent and read its one line response.
+// returns false when no agent is running, or when the socket or the
+// agent on it is not verified as ours, so keys are never sent to it.
+func agentRequest(request string) (string, bool) {
+	socket := agentSocketPath()
+	if _, err := os.Lstat(socket); err != nil {
+		return "", false
+	}
+	for _, err := range []error{checkAgentPath(path.Dir(socket), true), checkAgentPath(socket, false)} {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "warning: ignoring agent:", err)
+			return "", false
+		}
+	}
+	conn, err := net.DialTimeout("unix", socket, time.Second)
+	if err != nil {
+		return "", false
+	}
+	defer func() { _ = conn.Close() }()
+	err = checkAgentPeer(conn)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "warning: ignoring agent:", err)
+		return "", false
+	}
+	err = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err != nil {
+		return "", false
+	}
+	_, err = fmt.Fprintln(conn, request)
+	if err != nil {
+		return "", false
+	}
+	response, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimRight(response, "\n"), true
+}
+
+func agentGet(id string) ([]byte, bool) {
+	response, ok := agentRequest("get " + id)
+	if !ok {
+		return nil, false
+	}
+	keyHex, ok := strings.CutPrefix(response, "ok ")
+	if !ok {
+		return nil, false
+	}
+	key, err := hex.DecodeString(keyHex)
+	if err != nil {
+		return nil, false
+	}
+	return key, true
+}
+
+func agentPut(id string, key []byte) {
+	_, _ = agentRequest("put " + id + " " + hex.EncodeToString(key))
+}
+
+// a cached secret key, cleared by its timer at ttl
+type agentEntry struct {
+	key   []byte
+	timer *time.Timer
+}
+
+// the secret keys held by the agent. each is cleared at ttl by a timer,
+// so keys are gone on time even when no request arrives.
+type agentCache struct {
+	mutex   sync.Mutex
+	ttl     time.Duration
+	entries map[string]*agentEntry
+}
+
+func newAgentCache(ttl time.Duration) *agentCache {
+	return &agentCache{ttl: ttl, entries: map[string]*agentEntry{}}
+}
+
+// the hex of a cached key
+func (c *agentCache) get(id string) (string, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry, ok := c.entries[id]
+	if !ok {
+		return "", false
+	}
+	return hex.EncodeToString(entry.key), true
+}
+
+func (c *agentCache) put(id string, key []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	old, ok := c.entries[id]
+	if ok {
+		old.timer.Stop()
+		clear(old.key)
+	}
+	entry := &agentEntry{key: key}
+	c.entries[id] = entry
+	entry.timer = time.AfterFunc(c.ttl, func() {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		if c.entries[id] == entry {
+			clear(entry.key)
+			delete(c.entries, id)
+		}
+	})
+}
+
+// serve cached secret keys until the listener is closed. each
+// connection sends one request line:
+//
+//	get <id>        => ok <hex> | miss
+//	put <id> <hex>  => ok
+func serveAgent(listener net.Listener, ttl time.Duration) {
+	cache := newAgentCache(ttl)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			panic(err)
+		}
+		go func() {
+			defer func() { _ = conn.Close() }()
+			err := checkAgentPeer(conn)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "refusing agent connection:", err)
+				return
+			}
+			_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+			request, err := bufio.NewReader(conn).ReadString('\n')
+			if err != nil {
+				return
+			}
+			fields := strings.Fields(request)
+			switch {
+			case len(fields) == 2 && fields[0] == "get":
+				keyHex, ok := cache.get(fields[1])
+				if ok {
+					_, _ = fmt.Fprintln(conn, "ok "+keyHex)
+				} else {
+					_, _ = fmt.Fprintln(conn, "miss")
+				}
+			case len(fields) == 3 && fields[0] == "put":
+				key, err := hex.DecodeString(fields[2])
+				if err != nil {
+					_, _ = fmt.Fprintln(conn, "error")
+					return
+				}
+				cache.put(fields[1], key)
+				_, _ = fmt.Fprintln(conn, "ok")
+			default:
+				_, _ = fmt.Fprintln(conn, "error")
+			}
+		}()
+	}
+}
+
+// listen on the agent socket, in a directory that must be private to
+// this user
+func listenAgent(socket string) net.Listener {
+	err := os.MkdirAll(path.Dir(socket), 0o700)
+	if err != nil {
+		panic(err)
+	}
+	err = checkAgentPath(path.Dir(socket), true)
+	if err != nil {
+		panic("refusing to use agent directory: " + err.Error())
+	}
+	_, ok := agentRequest("get ping")
+	if ok {
+		panic("agent is already running: " + socket)
+	}
+	if checkAgentPath(socket, false) == nil {
+		_ = os.Remove(socket) // stale socket from an agent that exited
+	}
+	oldUmask := syscall.Umask(0o077)
+	listener, err := net.Listen("unix", socket)
+	syscall.Umask(oldUmask)
+	if err != nil {
+		panic(err)
+	}
+	err = checkAgentPath(socket, false)
+	if err != nil {
+		_ = listener.Close()
+		panic("refusing to use agent socket: " + err.Error())
+	}
+	return listener
+}
+
+// run the agent in the foreground, holding resolved secret keys in
+// memory for ttl
+func agent(ttl time.Duration) {
+	socket := agentSocketPath()
+	listener := listenAgent(socket)
+	fmt.Fprintln(os.Stderr, "agent listening:", socket)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		_ = listener.Close()
+	}()
+	serveAgent(listener, ttl)
+}
+
+// the subset of the kms client used for envelope encryption, so tests
+// can use a local stand-in
+type kmsAPI interface {
+	Encrypt(ctx context.Context, input *kms.EncryptInput, optFns ...func(*kms.Options)) (*kms.EncryptOutput, error)
+	Decrypt(ctx context.Context, input *kms.DecryptInput, optFns ...func(*kms.Options)) (*kms.DecryptOutput, error)
+}
+
+var kmsClient kmsAPI
+
+func getKmsClient() kmsAPI {
+	if kmsClient == nil {
+		cfg, err := config.LoadDefaultConfig(context.Background())
+		if err != nil {
+			panic(err)
+		}
+		kmsClient = kms.NewFromConfig(cfg)
+	}
+	return kmsClient
+}
+
+// bind a wrapped data key to its bundle, so it cannot be swapped with
+// the data key of another bundle
+func kmsEncryptionContext(bundleName string) map[string]string {
+	return map[string]string{"git-remote-aws:bundle": bundleName}
+}
+
+// generate a data keypair for a bundle, returning the public key to
+// encrypt to and the secret key wrapped by kms as base64
+func kmsDataKey(kmsKeyID, bundleName string) ([]byte, string) {
+	pk, sk, err := libsodium.BoxKeypair()
+	if err != nil {
+		panic(err)
+	}
+	defer clear(sk)
+	fmt.Fprintln(os.Stderr, "kms encrypt data key:", kmsKeyID)
+	out, err := getKmsClient().Encrypt(context.Background(), &kms.EncryptInput{
+		KeyId:             aws.String(kmsKeyID),
+		Plaintext:         sk,
+		EncryptionContext: kmsEncryptionContext(bundleName),
+	})
+	if err != nil {
+		panic(fmt.Errorf("kms encrypt failed for %s: %w", kmsKeyID, err))
+	}
+	return pk, base64.StdEncoding.EncodeToString(out.CiphertextBlob)
+}
+
+func kmsDecryptDataKey(bundle Bundle) ([]byte, error) {
+	blob, err := base64.StdEncoding.DecodeString(bundle.KmsKey)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintln(os.Stderr, "kms decrypt data key:", bundle.Name)
+	out, err := getKmsClient().Decrypt(context.Background(), &kms.DecryptInput{
+		CiphertextBlob:    blob,
+		EncryptionContext: kmsEncryptionContext(bundle.Name),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Plaintext, nil
+}
+
+// whether a local secret key is configured
+func hasSecretKey() bool {
+	kind, _ := secretKeySource()
+	return kind != ""
+}
+
+// the secret key to decrypt a bundle. bundles with a kms data key are
+// decrypted with it when kms:Decrypt is allowed, falling back to the
+// local secret key for recipients in .publickeys.
+func bundleSecretKey(remotePath string, bundle Bundle) []byte {
+	if bundle.KmsKey == "" {
+		return secretKey(remotePath)
+	}
+	dataKey, err := kmsDecryptDataKey(bundle)
+	if err == nil {
+		return dataKey
+	}
+	if !hasSecretKey() {
+		panic(fmt.Errorf("kms decrypt failed for bundle %s: %w", bundle.Name, err))
+	}
+	fmt.Fprintln(os.Stderr, "kms decrypt failed, using local secret key:", err)
+	return secretKey(remotePath)
+}
+
+// a secret key encrypted with a passphrase. the passphrase is stretched
+// with argon2id and the key is sealed with secretbox.
+type KeyFile struct {
+	Version    int    `json:"version"`
+	PublicKey  string `json:"publickey"`
+	Kdf        string `json:"kdf"`
+	Salt       string `json:"salt"`
+	Time       uint32 `json:"time"`
+	Memory     uint32 `json:"memory"`
+	Threads    uint8  `json:"threads"`
+	Nonce      string `json:"nonce"`
+	Ciphertext string `json:"ciphertext"`
+}
+
+func (k *KeyFile) publicKey() []byte {
+	publicKey, err := hex.DecodeString(k.PublicKey)
+	if err != nil {
+		panic(fmt.Errorf("key file publickey is not valid hex: %w", err))
+	}
+	return publicKey
+}
+
+func (k *KeyFile) key(passphrase []byte) *[32]byte {
+	salt, err := hex.DecodeString(k.Salt)
+	if err != nil {
+		panic(fmt.Errorf("key file salt is not valid hex: %w", err))
+	}
+	var key [32]byte
+	copy(key[:], argon2.IDKey(passphrase, salt, k.Time, k.Memory, k.Threads, 32))
+	return &key
+}
+
+// GIT_REMOTE_AWS_KEYFILE, or ~/.config/git-remote-aws/key
+func keyFilePath() string {
+	env := os.Getenv("GIT_REMOTE_AWS_KEYFILE")
+	if env != "" {
+		return env
+	}
+	configDir := os.Getenv("XDG_CONFIG_HOME")
+	if configDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			panic(err)
+		}
+		configDir = path.Join(home, ".config")
+	}
+	return path.Join(configDir, "git-remote-aws", "key")
+}
+
+// the key file, and whether it exists
+func readKeyFile() (*KeyFile, bool) {
+	data, err := os.ReadFile(keyFilePath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, false
+		}
+		panic(err)
+	}
+	keyFile := &KeyFile{}
+	err = json.Unmarshal(data, keyFile)
+	if err != nil {
+		panic(fmt.Errorf("malformed key file %s: %w", keyFilePath(), err))
+	}
+	if keyFile.Version != 1 || keyFile.Kdf != "argon2id" {
+		panic(fmt.Sprintf("unsupported key file %s: version=%d kdf=%s", keyFilePath(), keyFile.Version, keyFile.Kdf))
+	}
+	return keyFile, true
+}
+
+func encryptKeyFile(publicKey, secretKey, passphrase []byte) *KeyFile {
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	if err != nil {
+		panic(err)
+	}
+	var nonce [24]byte
+	_, err = rand.Read(nonce[:])
+	if err != nil {
+		panic(err)
+	}
+	keyFile := &KeyFile{
+		Version:   1,
+		PublicKey: hex.EncodeToString(publicKey),
+		Kdf:       "argon2id",
+		Salt:      hex.EncodeToString(salt),
+		Time:      3,
+		Memory:    64 * 1024,
+		Threads:   4,
+		Nonce:     hex.EncodeToString(nonce[:]),
+	}
+	ciphertext := secretbox.Seal(nil, secretKey, &nonce, keyFile.key(passphrase))
+	keyFile.Ciphertext = hex.EncodeToString(ciphertext)
+	return keyFile
+}
+
+func decryptKeyFile(keyFile *KeyFile, passphrase []byte) []byte {
+	nonceBytes, err := hex.DecodeString(keyFile.Nonce)
+	if err != nil || len(nonceBytes) != 24 {
+		panic("key file nonce is not valid")
+	}
+	var nonce [24]byte
+	copy(nonce[:], nonceBytes)
+	ciphertext, err := hex.DecodeString(keyFile.Ciphertext)
+	if err != nil {
+		panic(fmt.Errorf("key file ciphertext is not valid hex: %w", err))
+	}
+	secretKey, ok := secretbox.Open(nil, ciphertext, &nonce, keyFile.key(passphrase))
+	if !ok {
+		panic("wrong passphrase for key file " + keyFilePath())
+	}
+	return secretKey
+}
+
+// read a passphrase from the terminal, since stdin and stdout belong to
+// git when running as a git helper. for automation the passphrase is
+// printed by GIT_REMOTE_AWS_PASSPHRASE_CMD, so it is never kept in the
+// environment.
+func readPassphrase(prompt string, confirm bool) []byte {
+	cmdEnv := os.Getenv("GIT_REMOTE_AWS_PASSPHRASE_CMD")
+	if cmdEnv != "" {
+		var stdout bytes.Buffer
+		var stderr bytes.Buffer
+		cmd := exec.Command(cmdEnv)
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		err := cmd.Run()
+		if err != nil {
+			panic(fmt.Errorf("GIT_REMOTE_AWS_PASSPHRASE_CMD failed: %w: %s", err, stderr.String()))
+		}
+		passphrase := bytes.TrimRight(stdout.Bytes(), "\r\n")
+		if len(passphrase) == 0 {
+			panic("passphrase cannot be empty")
+		}
+		return passphrase
+	}
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		panic(fmt.Errorf("no terminal to read passphrase from, set GIT_REMOTE_AWS_PASSPHRASE_CMD: %w", err))
+	}
+	defer func() { _ = tty.Close() }()
+	_, _ = fmt.Fprint(tty, prompt)
+	passphrase, err := term.ReadPassword(int(tty.Fd()))
+	_, _ = fmt.Fprintln(tty)
+	if err != nil {
+		panic(err)
+	}
+	if len(passphrase) == 0 {
+		panic("passphrase cannot be empty")
+	}
+	if confirm {
+		_, _ = fmt.Fprint(tty, "confirm "+prompt)
+		again, err := term.ReadPassword(int(tty.Fd()))
+		_, _ = fmt.Fprintln(tty)
+		if err != nil {
+			panic(err)
+		}
+		if !bytes.Equal(passphrase, again) {
+			panic("passphrases do not match")
+		}
+	}
+	return passphrase
+}
+
+// generate a keypair, printing it as export statements, or writing it to
+// a passphrase encrypted key file when out is set
+func keygen(out string) {
+	pk, sk, err := libsodium.BoxKeypair()
+	if err != nil {
+		panic(err)
+	}
+	if out == "" {
+		fmt.Printf("export GIT_REMOTE_AWS_PUBLICKEY=%s\n", hex.EncodeToString(pk))
+		fmt.Printf("export GIT_REMOTE_AWS_SECRETKEY=%s\n", hex.EncodeToString(sk))
+		return
+	}
+	_, err = os.Stat(out)
+	if err == nil {
+		panic("key file already exists: " + out)
+	}
+	data, err := json.MarshalIndent(encryptKeyFile(pk, sk, readPassphrase("passphrase for "+out+": ", true)), "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	err = os.MkdirAll(path.Dir(out), 0o700)
+	if err != nil {
+		panic(err)
+	}
+	err = os.WriteFile(out, append(data, '\n'), 0o600)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Fprintln(os.Stderr, "wrote key file:", out)
+	if out != keyFilePath() {
+		fmt.Printf("export GIT_REMOTE_AWS_KEYFILE=%s\n", out)
+	}
+	fmt.Printf("export GIT_REMOTE_AWS_PUBLICKEY=%s\n", hex.EncodeToString(pk))
+}
+
+// git helper fetch
+func fetch(table, bucket, prefix, remotePath, command string, depth int) {
+
+	// parse args to get the requested hash and branch name. the ref is
+	// the remote branch, whatever local ref it is fetched into, or the
+	// hash itself for git fetch origin $shasum.
 	parts := strings.SplitN(command[len("fetch "):], " ", 2) // fetch $shasum refs/heads/$branch
-	ref := parts[1]                                          // refs/heads/master
-	branch := refBranch(ref)
+	want := parts[0]
+	ref := parts[1] // refs/heads/master
+	branch := ""
+	if ref != want {
+		branch = refBranch(ref)
+	}
+
+	fmt.Fprintln(os.Stderr, "get dynamodb://"+table+"/"+bucket+"/"+prefix)
+	repoMeta, err := dynamolock.Read[RepoMeta](context.Background(), table, bucket+"/"+prefix)
+	if err != nil {
+		panic(err)
+	}
+	if repoMeta == nil {
+		repoMeta = &RepoMeta{}
+	} else {
+		fmt.Fprintln(os.Stderr, "got meta:", repoMeta)
+	}
+
+	// fetch remote branch and fail if it exists and is not the requested branch
+	if repoMeta.Branch == "" {
+		panic("remote not found")
+	}
+	if branch != "" && branch != repoMeta.Branch {
+		panic(fmt.Sprintf("remote has no branch %s, its branch is %s", branch, repoMeta.Branch))
+	}
+
+	// fetch remote bundles metadata
+	var bundles []Bundle
+	if repoMeta.BundlesS3Key != "" {
+		bundles = getBundles(bucket, repoMeta.BundlesS3Key)
+	}
+
+	// fetch up to and including the bundle ending at the requested hash,
+	// since the remote may have moved on after git listed it
+	end := slices.IndexFunc(bundles, func(bundle Bundle) bool { return hashEnd(bundle.Name) == want })
+	if end == -1 {
+		panic("remote has no bundle ending at " + want + ", fetch again")
+	}
+	bundles = bundles[:end+1]
+
+	// walk backward from newest to oldest through remote bundles.
+	// stop when the bundle end commit exists in the local object
+	// database, whatever local branch it is on. all bundles which do
+	// not exist in local need to be fetched.
+	var bundlesToFetch []Bundle
+	for _, bundle := range reverse(bundles) {
+		if gitHasCommit(hashEnd(bundle.Name)) {
+			break
+		}
+		bundlesToFetch = append(bundlesToFetch, bundle)
+	}
+	bundlesToFetch = reverse(bundlesToFetch)
+
+	// with depth 1, start from the checkpoint when local is behind it,
+	// getting the checkpoint and every commit after it. an unshallow
+	// fetch gets every bundle.
+	var checkpoint *Checkpoint
+	if depth == unshallowDepth {
+		bundlesToFetch = bundles
+	} else if depth > 0 && repoMeta.Checkpoint != nil {
+		for i, bundle := range bundlesToFetch {
+			if hashEnd(bundle.Name) == repoMeta.Checkpoint.Hash {
+				checkpoint = repoMeta.Checkpoint
+				bundlesToFetch = bundlesToFetch[i+1:]
+				break
+			}
+		}
+	} else if depth > 0 {
+		fmt.Fprintln(os.Stderr, "remote has no checkpoint, fetching full history")
+	}
+
+	// setup tempdir and defer cleanup
+	tempdir, err := os.MkdirTemp("/tmp", tempdirPrefix)
+	if err != nil {
+		panic(err)
+	}
+	defer func() { _ = os.RemoveAll(tempdir) }()
+
+	// fetch the checkpoint and unpack it as a shallow commit
+	if checkpoint != nil {
+		bundle := checkpoint.bundle()
+		fileEncrypted := path.Join(tempdir, bundle.Name)
+		getBundle(bucket, prefix, bundle, fileEncrypted)
+		file := fileEncrypted + ".decrypted"
+		decryptFile(bundleSecretKey(remotePath, bundle), fileEncrypted, file)
+		fmt.Fprintln(os.Stderr, "git index-pack:", bundle.Name)
+		gitUnpackCheckpoint(file, checkpoint.Hash)
+	}
+
+	// fetch remote bundles and unpack them
+	for _, bundle := range bundlesToFetch {
+
+		// fetch object and verify checksum
+		bundleFileEncrypted := path.Join(tempdir, bundle.Name)
+		getBundle(bucket, prefix, bundle, bundleFileEncrypted)
+
+		// decrypt
+		bundleFile := bundleFileEncrypted + ".decrypted"
+		decryptFile(bundleSecretKey(remotePath, bundle), bundleFileEncrypted, bundleFile)
+
+		// import
+		fmt.Fprintln(os.Stderr, "git unbundle:", path.Base(bundleFileEncrypted))
+		gitBundle("", "unbundle", bundleFile)
+
+		// remove
+		err = os.Remove(bundleFileEncrypted)
+		if err != nil {
+			panic(err)
+		}
+		err = os.Remove(bundleFile)
+		if err != nil {
+			panic(err)
+		}
+
+	}
+
+	// all history is local again
+	if depth == unshallowDepth {
+		err := os.Remove(gitShallowFile())
+		if err != nil && !os.IsNotExist(err) {
+			panic(err)
+		}
+	}
+
+	// communicate with git caller
+	fmt.Println("")
+}
+
+func encryptFile(recipients [][]byte, src, dst string) {
+	r, err := os.Open(src)
+	if err != nil {
+		panic(err)
+	}
+	w, err := os.Create(dst)
+	if err != nil {
+		_ = r.Close()
+		panic(err)
+	}
+	err = libsodium.StreamEncryptRecipients(recipients, r, w)
+	closeReadErr := r.Close()
+	closeWriteErr := w.Close()
+	if err != nil {
+		panic(err)
+	}
+	if closeReadErr != nil {
+		panic(closeReadErr)
+	}
+	if closeWriteErr != nil {
+		panic(closeWriteErr)
+	}
+}
+
+// refuse to push a bundle the pusher could not decrypt, so a wrong
+// .publickeys does not lock the pusher, or everyone, out. with kms,
+// access follows iam instead.
+func checkRecipients(recipients [][]byte) {
+	publicKey := publicKey()[0]
+	for _, recipient := range recipients {
+		if bytes.Equal(recipient, publicKey) {
+			return
+		}
+	}
+	panic("local public key " + hex.EncodeToString(publicKey) + " is not in .publickeys, refusing to push a bundle you cannot decrypt")
+}
+
+var errFirstBlock = errors.New("first block decrypted")
+
+// a writer that stops decryption at the first plaintext block
+type firstBlockWriter struct {
+	wrote bool
+}
+
+func (w *firstBlockWriter) Write([]byte) (int, error) {
+	w.wrote = true
+	return 0, errFirstBlock
+}
+
+// decrypt the first block of an encrypted file and discard it
+func testDecrypt(secretKey []byte, file string) {
+	r, err := os.Open(file)
+	if err != nil {
+		panic(err)
+	}
+	defer func() { _ = r.Close() }()
+	w := &firstBlockWriter{}
+	err = libsodium.StreamDecryptRecipients(secretKey, r, w)
+	if !w.wrote {
+		panic(fmt.Errorf("test decryption of %s failed, refusing to push: %v", path.Base(file), err))
+	}
+}
+
+func decryptFile(secretKey []byte, src, dst string) {
+	r, err := os.Open(src)
+	if err != nil {
+		panic(err)
+	}
+	w, err := os.Create(dst)
+	if err != nil {
+		_ = r.Close()
+		panic(err)
+	}
+	err = libsodium.StreamDecryptRecipients(secretKey, r, w)
+	closeReadErr := r.Close()
+	closeWriteErr := w.Close()
+	if err != nil {
+		panic(err)
+	}
+	if closeReadErr != nil {
+		panic(closeReadErr)
+	}
+	if closeWriteErr != nil {
+		panic(closeWriteErr)
+	}
+}
+
+// run git bundle in dir, or the current directory when dir is empty,
+// printing git output only on failure
+func gitBundle(dir string, args ...string) {
+	cmd := exec.Command("git", append([]string{"bundle"}, args...)...)
+	cmd.Dir = dir
+	var bundleStdout bytes.Buffer
+	var bundleStderr bytes.Buffer
+	cmd.Stderr = &bundleStderr
+	cmd.Stdout = &bundleStdout
+	err := cmd.Run()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, bundleStderr.String())
+		fmt.Fprintln(os.Stderr, bundleStdout.String())
+		panic(fmt.Errorf("git bundle %s failed: %w", args[0], err))
+	}
+}
+
+// git helper list
+func list(table, bucket, prefix string) {
+
+	fmt.Fprintln(os.Stderr, "get dynamodb://"+table+"/"+bucket+"/"+prefix)
+	repoMeta, err := dynamolock.Read[RepoMeta](context.Background(), table, bucket+"/"+prefix)
+	if err != nil {
+		panic(err)
+	}
+	if repoMeta == nil {
+		repoMeta = &RepoMeta{}
+	} else {
+		fmt.Fprintln(os.Stderr, "got meta:", repoMeta)
+	}
+
+	// find remote branch, falling back to default branch
+	branch := defaultBranch
+	if repoMeta != nil && repoMeta.Branch != "" {
+		branch = repoMeta.Branch
+	}
+
+	// fetch remote bundles metadata
+	var remoteBundles []Bundle
+	if repoMeta != nil && repoMeta.BundlesS3Key != "" {
+		remoteBundles = getBundles(bucket, repoMeta.BundlesS3Key)
+	}
+
+	// communicate with git caller
+	if len(remoteBundles) > 0 {
+		// if remote bundles exist, print the latest hash
+		hash := hashEnd(last(remoteBundles).Name)
+		if len(hash) == 64 {
+			fmt.Println(":object-format sha256")
+		}
+		fmt.Println(hash, "refs/heads/"+branch)
+		fmt.Println("@refs/heads/"+branch, "HEAD")
+	} else {
+		// else print the zero hash
+		var stdout bytes.Buffer
+		cmd := exec.Command("git", "config", "extensions.objectformat")
+		cmd.Stdout = &stdout
+		err := cmd.Run()
+		objectFormat := ""
+		if err == nil {
+			objectFormat = strings.Trim(stdout.String(), "\n")
+		}
+		if objectFormat == "sha256" {
+			fmt.Println(zeroHash256, "HEAD")
+		} else {
+			fmt.Println(zeroHash, "HEAD")
+		}
+	}
+	fmt.Println("")
+}
+
+// all objects directly under a prefix. remotes can be nested, so
+// objects of other remotes deeper in the prefix are excluded.
+func listObjects(bucket, prefix string) []s3types.Object {
+	var objects []s3types.Object
+	paginator := s3.NewListObjectsV2Paginator(lib.S3Client(), &s3.ListObjectsV2Input{
+		Bucket:    aws.String(bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	})
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(context.Background())
+		if err != nil {
+			panic(err)
+		}
+		objects = append(objects, out.Contents...)
+	}
+	return objects
+}
+
+// problems found by fsck. checks panic like everything else, and the
+// panic is recorded as a problem so fsck can keep going.
+type fsckReport struct {
+	problems int
+}
+
+func (r *fsckReport) check(name string, f func()) (ok bool) {
+	defer func() {
+		if err := recover(); err != nil {
+			r.problems++
+			ok = false
+			fmt.Println("error", name+":", err)
+		}
+	}()
+	f()
+	fmt.Println("ok", name)
+	return true
+}
+
+// objects not reachable from the current metadata, sorted by key
+func orphans(prefix string, repoMeta *RepoMeta, bundles []Bundle, objects map[string]s3types.Object) []s3types.Object {
+	reachable := map[string]bool{}
+	if repoMeta.BundlesS3Key != "" {
+		reachable[repoMeta.BundlesS3Key] = true
+	}
+	for _, bundle := range bundles {
+		reachable[prefix+"/"+bundle.Name] = true
+	}
+	if repoMeta.Checkpoint != nil {
+		reachable[prefix+"/"+repoMeta.Checkpoint.bundle().Name] = true
+	}
+	var result []s3types.Object
+	for key, object := range objects {
+		if !reachable[key] {
+			result = append(result, object)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return *result[i].Key < *result[j].Key })
+	return result
+}
+
+// delete orphaned objects, left behind by pushes that failed part way,
+// once they are older than the grace period
+func gc(remotePath string, grace time.Duration, dryRun bool) {
+	bucket, table, prefix := parseRemote(remotePath)
+
+	// hold the lock so no push is writing new objects while we look
+	unlock, _, repoMeta := lockRemote(table, bucket, prefix)
+	defer func() {
+		err := unlock(context.Background(), repoMeta)
+		if err != nil {
+			panic(err)
+		}
+	}()
+	repoMeta.checkWritable(remotePath)
+	bundles := getBundles(bucket, repoMeta.BundlesS3Key)
+
+	objects := map[string]s3types.Object{}
+	for _, object := range listObjects(bucket, prefix+"/") {
+		objects[*object.Key] = object
+	}
+	for _, object := range orphans(prefix, repoMeta, bundles, objects) {
+		location := "s3://" + bucket + "/" + *object.Key
+		age := time.Since(*object.LastModified)
+		if age < grace {
+			fmt.Println("skip orphan within grace period:", location, age.Round(time.Second))
+			continue
+		}
+		if dryRun {
+			fmt.Println("would delete orphan:", location)
+			continue
+		}
+		s3Delete(bucket, *object.Key)
+		fmt.Println("deleted orphan:", location)
+	}
+}
+
+// ask on the terminal for expected to be typed back
+func confirm(prompt, expected string) bool {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		panic(fmt.Errorf("no terminal to confirm on, use --yes: %w", err))
+	}
+	defer func() { _ = tty.Close() }()
+	_, _ = fmt.Fprint(tty, prompt)
+	line, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil && err != io.EOF {
+		panic(err)
+	}
+	return strings.TrimSpace(line) == expected
+}
+
+// the largest object a single CopyObject can copy, and the part size of
+// larger copies
+const (
+	maxCopyObjectSize = 5 << 30
+	copyPartSize      = 512 << 20
+)
+
+// the url encoded copy source of an object
+func s3CopySource(bucket, key string) *string {
+	return aws.String(strings.ReplaceAll(url.PathEscape(bucket+"/"+key), "%2F", "/"))
+}
+
+// change the storage class of an object by copying it in place. objects
+// larger than a single copy allows are copied in parts.
+func s3Archive(bucket, key string, size int64, storageClass s3types.StorageClass) {
+	fmt.Fprintln(os.Stderr, "archive s3://"+bucket+"/"+key, storageClass)
+	copySource := s3CopySource(bucket, key)
+	if size <= maxCopyObjectSize {
+		_, err := lib.S3Client().CopyObject(context.Background(), &s3.CopyObjectInput{
+			Bucket:            aws.String(bucket),
+			Key:               aws.String(key),
+			CopySource:        copySource,
+			StorageClass:      storageClass,
+			MetadataDirective: s3types.MetadataDirectiveCopy,
+			ChecksumAlgorithm: s3types.ChecksumAlgorithmSha256,
+		})
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	// a multipart upload does not copy metadata, so carry it over
+	head, err := lib.S3Client().HeadObject(context.Background(), &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		panic(err)
+	}
+	upload, err := lib.S3Client().CreateMultipartUpload(context.Background(), &s3.CreateMultipartUploadInput{
+		Bucket:            aws.String(bucket),
+		Key:               aws.String(key),
+		StorageClass:      storageClass,
+		Metadata:          head.Metadata,
+		ContentType:       head.ContentType,
+		ChecksumAlgorithm: s3types.ChecksumAlgorithmSha256,
+	})
+	if err != nil {
+		panic(err)
+	}
+	completed := false
+	defer func() {
+		if !completed {
+			_, _ = lib.S3Client().AbortMultipartUpload(context.Background(), &s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(bucket),
+				Key:      aws.String(key),
+				UploadId: upload.UploadId,
+			})
+		}
+	}()
+	var parts []s3types.CompletedPart
+	for start := int64(0); start < size; start += copyPartSize {
+		end := min(start+copyPartSize, size) - 1
+		partNumber := aws.Int32(int32(len(parts) + 1))
+		out, err := lib.S3Client().UploadPartCopy(context.Background(), &s3.UploadPartCopyInput{
+			Bucket:          aws.String(bucket),
+			Key:             aws.String(key),
+			CopySource:      copySource,
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+			PartNumber:      partNumber,
+			UploadId:        upload.UploadId,
+		})
+		if err != nil {
+			panic(err)
+		}
+		parts = append(parts, s3types.CompletedPart{
+			ETag:           out.CopyPartResult.ETag,
+			ChecksumSHA256: out.CopyPartResult.ChecksumSHA256,
+			PartNumber:     partNumber,
+		})
+	}
+	_, err = lib.S3Client().CompleteMultipartUpload(context.Background(), &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(bucket),
+		Key:             aws.String(key),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &s3types.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		panic(err)
+	}
+	completed = true
+}
+
+// delete a remote, or archive it to glacier instant retrieval and mark
+// it read-only. objects are deleted or archived under the lock, then the
+// item is deleted once unlocked, unless another push has locked it since.
+// an item left with empty metadata by an interrupted delete is deleted
+// again along with any objects that remain.
+func rm(remotePath string, yes, archive bool) {
+	bucket, table, prefix := parseRemote(remotePath)
+	action := "delete"
+	if archive {
+		action = "archive"
+	}
+	existing, err := dynamolock.Read[RepoMeta](context.Background(), table, bucket+"/"+prefix)
+	if err != nil {
+		panic(err)
+	}
+	if existing == nil || (archive && existing.BundlesS3Key == "") {
+		panic("remote not found: " + remotePath)
+	}
+	if !yes && !confirm("type "+prefix+" to "+action+" "+remotePath+": ", prefix) {
+		fmt.Fprintln(os.Stderr, "aborted")
+		os.Exit(1)
+	}
+
+	unlock, update, repoMeta := lockRemote(table, bucket, prefix)
+	unlocked := false
+	defer func() {
+		if !unlocked {
+			err := unlock(context.Background(), repoMeta)
+			if err != nil {
+				panic(err)
+			}
+		}
+	}()
+	if archive && repoMeta.BundlesS3Key == "" {
+		panic("remote not found: " + remotePath)
+	}
+	if repoMeta.BundlesS3Key == "" {
+		fmt.Fprintln(os.Stderr, "finishing an interrupted delete:", remotePath)
+	}
+
+	if archive {
+		for _, object := range listObjects(bucket, prefix+"/") {
+			if object.StorageClass != s3types.ObjectStorageClassGlacierIr {
+				s3Archive(bucket, *object.Key, *object.Size, s3types.StorageClassGlacierIr)
+			}
+		}
+		repoMeta.State = stateArchived
+		err = unlock(context.Background(), repoMeta)
+		if err != nil {
+			panic(err)
+		}
+		unlocked = true
+		fmt.Println("archived", remotePath)
+		return
+	}
+
+	// empty the metadata first so a push racing us sees an empty remote
+	// rather than one pointing at deleted objects
+	repoMeta.BundlesS3Key = ""
+	repoMeta.Branch = ""
+	repoMeta.Checkpoint = nil
+	err = update(context.Background(), repoMeta)
+	if err != nil {
+		panic(err)
+	}
+	for _, object := range listObjects(bucket, prefix+"/") {
+		s3Delete(bucket, *object.Key)
+	}
+	err = unlock(context.Background(), repoMeta)
+	if err != nil {
+		panic(err)
+	}
+	unlocked = true
+
+	fmt.Fprintln(os.Stderr, "delete dynamodb://"+table+"/"+bucket+"/"+prefix)
+	_, err = lib.DynamoDBClient().DeleteItem(context.Background(), &dynamodb.DeleteItemInput{
+		TableName: aws.String(table),
+		Key: map[string]ddbtypes.AttributeValue{
+			"id": &ddbtypes.AttributeValueMemberS{Value: bucket + "/" + prefix},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(#uid) OR attribute_type(#uid, :null)"),
+		ExpressionAttributeNames: map[string]string{
+			"#uid": lockAttrUid,
+		},
+		ExpressionAttributeValues: map[string]ddbtypes.AttributeValue{
+			":null": &ddbtypes.AttributeValueMemberS{Value: "NULL"},
+		},
+	})
+	if err != nil {
+		panic(fmt.Errorf("failed to delete dynamodb://%s/%s/%s, it was locked again after its objects were deleted: %w", table, bucket, prefix, err))
+	}
+	fmt.Println("deleted", remotePath)
+}
+
+// mark a remote read-only, or writable again. list and fetch keep
+// working while a remote is frozen.
+func freeze(remotePath string, frozen bool) {
+	bucket, table, prefix := parseRemote(remotePath)
+	existing, err := dynamolock.Read[RepoMeta](context.Background(), table, bucket+"/"+prefix)
+	if err != nil {
+		panic(err)
+	}
+	if existing == nil || existing.BundlesS3Key == "" {
+		panic("remote not found: " + remotePath)
+	}
+	unlock, _, repoMeta := lockRemote(table, bucket, prefix)
+	defer func() {
+		err := unlock(context.Background(), repoMeta)
+		if err != nil {
+			panic(err)
+		}
+	}()
+	if repoMeta.State == stateArchived {
+		panic("remote is archived, archived remotes cannot be frozen or unfrozen: " + remotePath)
+	}
+	if frozen {
+		repoMeta.State = stateFrozen
+		fmt.Println("frozen", remotePath)
+	} else {
+		repoMeta.State = ""
+		fmt.Println("unfrozen", remotePath)
+	}
+}
+
+// parse a size in bytes with an optional K, M, or G suffix
+func parseSize(size string) int64 {
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(size, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(size, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(size, "G"):
+		multiplier = 1 << 30
+	}
+	n, err := strconv.ParseInt(strings.TrimRight(size, "KMG"), 10, 64)
+	if err != nil || n <= 0 {
+		panic("invalid size: " + size)
+	}
+	return n * multiplier
+}
+
+// run git and return its stdout
+func gitOut(args ...string) string {
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	cmd := exec.Command("git", args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		panic("failed to run: git " + strings.Join(args, " ") + ": " + stderr.String())
+	}
+	return stdout.String()
+}
+
+// the on disk size of the objects in start..end, an estimate of the
+// size of their bundle
+func gitDiskUsage(start, end string) int64 {
+	args := []string{"rev-list", "--objects", "--disk-usage", end}
+	if start != "" {
+		args = append(args, "^"+start)
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(gitOut(args...)), 10, 64)
+	if err != nil {
+		panic(err)
+	}
+	return size
+}
+
+// split first-parent commits after start into chunks whose objects are
+// at most maxSize bytes on disk, returning the end commit of each chunk.
+// a single commit larger than maxSize is a chunk of its own.
+func importChunks(commits []string, start string, maxSize int64) []string {
+	var ends []string
+	i := 0
+	for i < len(commits) {
+		// binary search for the furthest commit that fits
+		lo, hi := i, len(commits)-1
+		end := i
+		for lo <= hi {
+			mid := (lo + hi) / 2
+			if gitDiskUsage(start, commits[mid]) <= maxSize {
+				end = mid
+				lo = mid + 1
+			} else {
+				hi = mid - 1
+			}
+		}
+		ends = append(ends, commits[end])
+		start = commits[end]
+		i = end + 1
+	}
+	return ends
+}
 
-	fmt.Fprintln(os.Stderr, "get dynamodb://"+table+"/"+bucket+"/"+prefix)
-	repoMeta, err := dynamolock.Read[RepoMeta](context.Background(), table, bucket+"/"+prefix)
+// import the history of a local branch into a remote as bundles of
+// bounded size along first-parent commits. each chunk is its own locked
+// push, so an interrupted import resumes from the remote tip.
+func importRepo(remotePath, branch string, maxSize int64) {
+	bucket, table, prefix := parseRemote(remotePath)
+	if branch == "" {
+		branch = strings.TrimSpace(gitOut("symbolic-ref", "--short", "HEAD"))
+	}
+	refBranch("refs/heads/" + branch)
+	root := strings.TrimSpace(gitOut("rev-parse", "--show-toplevel"))
+	err := os.Chdir(root)
 	if err != nil {
 		panic(err)
 	}
-	if repoMeta == nil {
-		repoMeta = &RepoMeta{}
-	} else {
-		fmt.Fprintln(os.Stderr, "got meta:", repoMeta)
-	}
+	ensureBucketAndTable(bucket, table)
 
-	// fetch remote branch and fail if it exists and is not equal to local branch
-	if repoMeta.Branch == "" {
-		panic("remote not found")
+	// resume from the remote tip
+	commits := strings.Fields(gitOut("rev-list", "--first-parent", "--reverse", branch))
+	start := ""
+	repoMeta, err := dynamolock.Read[RepoMeta](context.Background(), table, bucket+"/"+prefix)
+	if err != nil {
+		panic(err)
 	}
-	if branch != repoMeta.Branch {
-		panic(fmt.Sprintf("remote branch does not match local branch, %s != %s", branch, repoMeta.Branch))
+	if repoMeta != nil && repoMeta.BundlesS3Key != "" {
+		bundles := getBundles(bucket, repoMeta.BundlesS3Key)
+		if len(bundles) > 0 {
+			start = hashEnd(last(bundles).Name)
+			contains, _ := gitBranchContains(branch, start)
+			if !contains {
+				panic("remote has commits that are not in " + branch + ", cannot import")
+			}
+			// ancestry of the remote tip is monotonic along first-parent
+			i := sort.Search(len(commits), func(i int) bool {
+				contains, _ := gitBranchContains(commits[i], start)
+				return contains
+			})
+			if i < len(commits) && commits[i] == start {
+				i++
+			}
+			commits = commits[i:]
+			fmt.Fprintln(os.Stderr, "resuming import from", start)
+		}
 	}
-
-	// fetch remote bundles metadata
-	var bundles []string
-	if repoMeta.BundlesS3Key != "" {
-		bundles = getBundles(bucket, repoMeta.BundlesS3Key)
+	if len(commits) == 0 {
+		fmt.Fprintln(os.Stderr, "import up to date:", remotePath)
+		return
 	}
 
-	// walk backward from newest to oldest through remote bundles.
-	// stop when the bundle end commit exists in the local data. all
-	// bundles which do not exist in local need to be fetched.
-	var bundlesToFetch []string
-	for _, bundle := range reverse(bundles) {
-		hash := hashEnd(bundle)
-		contains, known := gitBranchContains(branch, hash)
-		if known && contains {
-			break
-		}
-		bundlesToFetch = append(bundlesToFetch, bundle)
+	// bundle each chunk through a temporary ref
+	ref := "refs/git-remote-aws/import"
+	defer func() { _ = exec.Command("git", "update-ref", "-d", ref).Run() }()
+	ends := importChunks(commits, start, maxSize)
+	for i, end := range ends {
+		gitOut("update-ref", ref, end)
+		fmt.Fprintf(os.Stderr, "import chunk %d/%d: %s\n", i+1, len(ends), end)
+		pushRef(table, bucket, prefix, remotePath, branch, ref)
 	}
-	bundlesToFetch = reverse(bundlesToFetch)
+	fmt.Fprintln(os.Stderr, "imported", len(ends), "bundles to", remotePath)
+}
 
-	// setup tempdir and defer cleanup
-	tempdir, err := os.MkdirTemp("/tmp", tempdirPrefix)
+// the source remote of a mirror, as handed to a mirror running in the
+// destination region
+type MirrorSource struct {
+	Bucket     string   `json:"bucket"`
+	Prefix     string   `json:"prefix"`
+	Branch     string   `json:"branch"`
+	Recipients int      `json:"recipients"`
+	Bundles    []Bundle `json:"bundles"`
+}
+
+// the region the aws clients are configured for
+func awsRegion() string {
+	cfg, err := config.LoadDefaultConfig(context.Background())
 	if err != nil {
 		panic(err)
 	}
-	defer func() { _ = os.RemoveAll(tempdir) }()
-
-	// fetch remote bundles and unpack them
-	for _, bundle := range bundlesToFetch {
+	return cfg.Region
+}
 
-		// fetch object
-		fmt.Fprintln(os.Stderr, "get s3://"+bucket+"/"+prefix+"/"+bundle)
-		out, err := lib.S3Client().GetObject(context.Background(), &s3.GetObjectInput{
-			Bucket: aws.String(bucket),
-			Key:    aws.String(prefix + "/" + bundle),
-		})
+// copy an encrypted bundle between buckets, which may be in different
+// regions, verifying its sha256 when one was recorded at push time.
+// bundles are put whole, so none is too large for a single copy.
+func copyBundle(srcBucket, srcPrefix, dstBucket, dstPrefix string, bundle Bundle) {
+	location := "s3://" + dstBucket + "/" + dstPrefix + "/" + bundle.Name
+	fmt.Fprintln(os.Stderr, "copy s3://"+srcBucket+"/"+srcPrefix+"/"+bundle.Name, location)
+	out, err := lib.S3Client().CopyObject(context.Background(), &s3.CopyObjectInput{
+		Bucket:            aws.String(dstBucket),
+		Key:               aws.String(dstPrefix + "/" + bundle.Name),
+		CopySource:        s3CopySource(srcBucket, srcPrefix+"/"+bundle.Name),
+		ChecksumAlgorithm: s3types.ChecksumAlgorithmSha256,
+	})
+	if err != nil {
+		panic(err)
+	}
+	if bundle.Sha256 != "" {
+		sum, err := hex.DecodeString(bundle.Sha256)
 		if err != nil {
 			panic(err)
 		}
-		bundleFileEncrypted := path.Join(tempdir, bundle)
-		f, err := os.Create(bundleFileEncrypted)
+		copied := aws.ToString(out.CopyObjectResult.ChecksumSHA256)
+		if copied != base64.StdEncoding.EncodeToString(sum) {
+			panic("bundle sha256 mismatch: " + location)
+		}
+	}
+}
+
+// copy the bundles a destination remote is missing from a source
+// remote. bundles are copied as ciphertext within s3, so no secret key
+// is needed. the destination must hold a prefix of the source bundles,
+// and its metadata is updated under its own lock. a destination bucket
+// in another region is mirrored by a child process configured for that
+// region, since its table and lock are there too.
+func mirror(srcPath, dstPath string) {
+	srcBucket, srcTable, srcPrefix := parseRemote(srcPath)
+	dstBucket, dstTable, dstPrefix := parseRemote(dstPath)
+	if srcBucket == dstBucket && srcTable == dstTable && srcPrefix == dstPrefix {
+		panic("cannot mirror a remote to itself: " + dstPath)
+	}
+	var source MirrorSource
+	if os.Getenv("GIT_REMOTE_AWS_MIRROR_SOURCE") == "stdin" {
+		err := json.NewDecoder(os.Stdin).Decode(&source)
 		if err != nil {
-			_ = out.Body.Close()
 			panic(err)
 		}
-		_, err = io.Copy(f, out.Body)
-		closeBodyErr := out.Body.Close()
-		closeFileErr := f.Close()
+	} else {
+		fmt.Fprintln(os.Stderr, "get dynamodb://"+srcTable+"/"+srcBucket+"/"+srcPrefix)
+		srcMeta, err := dynamolock.Read[RepoMeta](context.Background(), srcTable, srcBucket+"/"+srcPrefix)
 		if err != nil {
 			panic(err)
 		}
-		if closeBodyErr != nil {
-			panic(closeBodyErr)
+		if srcMeta == nil || srcMeta.BundlesS3Key == "" {
+			panic("remote not found: " + srcPath)
+		}
+		source = MirrorSource{
+			Bucket:     srcBucket,
+			Prefix:     srcPrefix,
+			Branch:     srcMeta.Branch,
+			Recipients: srcMeta.Recipients,
+			Bundles:    getBundles(srcBucket, srcMeta.BundlesS3Key),
 		}
-		if closeFileErr != nil {
-			panic(closeFileErr)
+		region, err := lib.S3BucketRegion(dstBucket)
+		if err == nil && region != awsRegion() {
+			mirrorInRegion(region, srcPath, dstPath, source)
+			return
 		}
+	}
+	mirrorTo(dstPath, source)
+}
 
-		// decrypt
-		bundleFile := bundleFileEncrypted + ".decrypted"
-		r, err := os.Open(bundleFileEncrypted)
-		if err != nil {
-			panic(err)
+// run a mirror in the region of its destination, handing it the source
+// read in this region
+func mirrorInRegion(region, srcPath, dstPath string, source MirrorSource) {
+	data, err := json.Marshal(source)
+	if err != nil {
+		panic(err)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		panic(err)
+	}
+	fmt.Fprintln(os.Stderr, "mirror in region", region+":", dstPath)
+	cmd := exec.Command(exe, "mirror", srcPath, dstPath)
+	cmd.Env = append(os.Environ(), "AWS_REGION="+region, "AWS_DEFAULT_REGION="+region, "GIT_REMOTE_AWS_MIRROR_SOURCE=stdin")
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = os.Stderr // stdout may be the git helper protocol
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		panic(fmt.Errorf("mirror in region %s failed: %w", region, err))
+	}
+}
+
+// copy the bundles a destination remote is missing from a mirror source
+func mirrorTo(dstPath string, source MirrorSource) {
+	dstBucket, dstTable, dstPrefix := parseRemote(dstPath)
+	srcBundles := source.Bundles
+	ensureBucketAndTable(dstBucket, dstTable)
+	unlock, update, dstMeta := lockRemote(dstTable, dstBucket, dstPrefix)
+	unlocked := false
+	defer func() {
+		if !unlocked {
+			err := unlock(context.Background(), dstMeta)
+			if err != nil {
+				panic(err)
+			}
+		}
+	}()
+	if dstMeta.State != "" {
+		panic("mirror destination is " + dstMeta.State + " and read-only: " + dstPath)
+	}
+	if dstMeta.Branch != "" && dstMeta.Branch != source.Branch {
+		panic(fmt.Sprintf("mirror destination has a different branch, %s != %s", dstMeta.Branch, source.Branch))
+	}
+	dstBundles := getBundles(dstBucket, dstMeta.BundlesS3Key)
+	if len(dstBundles) > len(srcBundles) {
+		panic("mirror destination has diverged from source: " + dstPath)
+	}
+	for i, bundle := range dstBundles {
+		if bundle.Name != srcBundles[i].Name {
+			panic("mirror destination has diverged from source at " + bundle.Name + ": " + dstPath)
+		}
+	}
+	missing := srcBundles[len(dstBundles):]
+	if len(missing) == 0 {
+		fmt.Fprintln(os.Stderr, "mirror up to date:", dstPath)
+		return
+	}
+
+	// journal the copy so an interrupted mirror is finished or rolled
+	// back like a push. bundles are copied in order, so the last one
+	// existing means they all do, and on rollback they are all deleted.
+	last := missing[len(missing)-1]
+	newBundlesS3Key := dstPrefix + "/bundles_" + hashEnd(last.Name)
+	oldBundlesS3Key := dstMeta.BundlesS3Key
+	var mirrorS3Keys []string
+	for _, bundle := range missing[:len(missing)-1] {
+		mirrorS3Keys = append(mirrorS3Keys, dstPrefix+"/"+bundle.Name)
+	}
+	dstMeta.Journal = &Journal{
+		Branch:          source.Branch,
+		BundleS3Key:     dstPrefix + "/" + last.Name,
+		BundlesS3Key:    newBundlesS3Key,
+		OldBundlesS3Key: oldBundlesS3Key,
+		MirrorS3Keys:    mirrorS3Keys,
+	}
+	err := update(context.Background(), dstMeta)
+	if err != nil {
+		panic(err)
+	}
+
+	for _, bundle := range missing {
+		copyBundle(source.Bucket, source.Prefix, dstBucket, dstPrefix, bundle)
+	}
+	putBundles(dstBucket, newBundlesS3Key, srcBundles)
+
+	dstMeta.BundlesS3Key = newBundlesS3Key
+	dstMeta.Branch = source.Branch
+	dstMeta.Recipients = source.Recipients
+	err = update(context.Background(), dstMeta)
+	if err != nil {
+		panic(err)
+	}
+	if oldBundlesS3Key != "" && oldBundlesS3Key != newBundlesS3Key {
+		s3Delete(dstBucket, oldBundlesS3Key)
+	}
+	dstMeta.Journal = nil
+	err = unlock(context.Background(), dstMeta)
+	if err != nil {
+		panic(err)
+	}
+	unlocked = true
+	fmt.Fprintln(os.Stderr, "mirrored", len(missing), "bundles to", dstPath)
+}
+
+// after a push, mirror the remote to every url in the multi-valued git
+// config remote.<name>.awsmirror. a failed mirror only warns, since the
+// push itself succeeded and the next push catches the mirror up.
+func pushMirrors(remoteName, remotePath string) {
+	var stdout bytes.Buffer
+	cmd := exec.Command("git", "config", "--get-all", "remote."+remoteName+".awsmirror")
+	cmd.Stdout = &stdout
+	err := cmd.Run()
+	if err != nil {
+		return // no mirrors configured
+	}
+	for _, mirrorPath := range strings.Fields(stdout.String()) {
+		func() {
+			defer func() {
+				r := recover()
+				if r != nil {
+					fmt.Fprintln(os.Stderr, "warning: mirror to", mirrorPath, "failed:", r)
+				}
+			}()
+			mirror(remotePath, mirrorPath)
+		}()
+	}
+}
+
+// the state of a remote
+type RemoteInfo struct {
+	Remote       string `json:"remote"`
+	Branch       string `json:"branch"`
+	BundlesS3Key string `json:"bundles"`
+	Locked       bool   `json:"locked"`
+	LockStale    bool   `json:"lock_stale"`
+	LockHolder   string `json:"lock_holder,omitempty"`
+	LockSince    string `json:"lock_since,omitempty"`
+	PendingPush  bool   `json:"pending_push"`
+	Bundles      int    `json:"bundle_count"`
+	Size         int64  `json:"size"`
+	Tip          string `json:"tip"`
+	HashFormat   string `json:"hash_format"`
+	Recipients   int    `json:"recipients"`
+	Kms          bool   `json:"kms"`
+	State        string `json:"state"`
+	Checkpoint   string `json:"checkpoint"`
+}
+
+// the attributes go-dynamolock keeps in the lock item next to the
+// metadata. uid is a string while the lock is held and null once it is
+// released, and unix is the heartbeat in unix seconds.
+const (
+	lockAttrUid  = "uid"
+	lockAttrUnix = "unix"
+)
+
+// whether the dynamolock item is locked, and its last heartbeat
+func lockStatus(table, id string) (bool, time.Time) {
+	out, err := lib.DynamoDBClient().GetItem(context.Background(), &dynamodb.GetItemInput{
+		TableName:      aws.String(table),
+		ConsistentRead: aws.Bool(true),
+		Key: map[string]ddbtypes.AttributeValue{
+			"id": &ddbtypes.AttributeValueMemberS{Value: id},
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	_, locked := out.Item[lockAttrUid].(*ddbtypes.AttributeValueMemberS)
+	var heartbeat time.Time
+	unix, ok := out.Item[lockAttrUnix].(*ddbtypes.AttributeValueMemberN)
+	if ok {
+		seconds, err := strconv.ParseInt(unix.Value, 10, 64)
+		if err == nil {
+			heartbeat = time.Unix(seconds, 0)
+		}
+	}
+	return locked, heartbeat
+}
+
+func remoteInfo(remotePath string) RemoteInfo {
+	bucket, table, prefix := parseRemote(remotePath)
+	fmt.Fprintln(os.Stderr, "get dynamodb://"+table+"/"+bucket+"/"+prefix)
+	repoMeta, err := dynamolock.Read[RepoMeta](context.Background(), table, bucket+"/"+prefix)
+	if err != nil {
+		panic(err)
+	}
+	if repoMeta == nil || repoMeta.Branch == "" || repoMeta.BundlesS3Key == "" {
+		panic("remote not found: " + remotePath)
+	}
+	info := RemoteInfo{
+		Remote:       remotePath,
+		Branch:       repoMeta.Branch,
+		BundlesS3Key: repoMeta.BundlesS3Key,
+		LockHolder:   repoMeta.LockHolder,
+		PendingPush:  repoMeta.Journal != nil,
+		Recipients:   repoMeta.Recipients,
+		State:        repoMeta.State,
+	}
+	if repoMeta.Checkpoint != nil {
+		info.Checkpoint = repoMeta.Checkpoint.Hash
+	}
+	var heartbeat time.Time
+	info.Locked, heartbeat = lockStatus(table, bucket+"/"+prefix)
+	if info.Locked {
+		info.LockStale = time.Since(heartbeat) > envDuration("GIT_REMOTE_AWS_LOCK_MAX_AGE", 10*time.Second)
+		info.LockSince = lockSince(repoMeta.LockUnix)
+	}
+	bundles := getBundles(bucket, repoMeta.BundlesS3Key)
+	info.Bundles = len(bundles)
+	if len(bundles) > 0 {
+		info.Tip = hashEnd(bundles[len(bundles)-1].Name)
+		info.HashFormat = "sha1"
+		if len(info.Tip) == 64 {
+			info.HashFormat = "sha256"
+		}
+	}
+	// older bundles metadata has no sizes, so sum the objects instead
+	objects := map[string]s3types.Object{}
+	for _, object := range listObjects(bucket, prefix+"/") {
+		objects[*object.Key] = object
+	}
+	for _, bundle := range bundles {
+		object, ok := objects[prefix+"/"+bundle.Name]
+		if ok {
+			info.Size += *object.Size
+		}
+		if bundle.KmsKey != "" {
+			info.Kms = true
 		}
-		w, err := os.Create(bundleFile)
+	}
+	return info
+}
+
+// print the state of a remote
+func printInfo(remotePath string, asJSON bool) {
+	info := remoteInfo(remotePath)
+	if asJSON {
+		data, err := json.MarshalIndent(info, "", "  ")
 		if err != nil {
-			_ = r.Close()
 			panic(err)
 		}
-		err = libsodium.StreamDecryptRecipients(secretKey(remotePath), r, w)
-		closeReadErr := r.Close()
-		closeWriteErr := w.Close()
+		fmt.Println(string(data))
+		return
+	}
+	fmt.Println("remote", info.Remote)
+	fmt.Println("branch", info.Branch)
+	fmt.Println("bundles", info.BundlesS3Key)
+	if info.Locked && info.LockStale {
+		fmt.Println("lock stale, last held by", info.LockHolder, "since", info.LockSince)
+	} else if info.Locked {
+		fmt.Println("lock held by", info.LockHolder, "since", info.LockSince)
+	} else {
+		fmt.Println("lock unlocked")
+	}
+	if info.PendingPush {
+		fmt.Println("pending push, finished or rolled back by the next lock holder")
+	}
+	fmt.Println("bundle count", info.Bundles)
+	fmt.Println("size", info.Size)
+	fmt.Println("tip", info.Tip)
+	fmt.Println("hash format", info.HashFormat)
+	fmt.Println("recipients", info.Recipients)
+	fmt.Println("kms", info.Kms)
+	if info.State == "" {
+		fmt.Println("state writable")
+	} else {
+		fmt.Println("state", info.State)
+	}
+	if info.Checkpoint != "" {
+		fmt.Println("checkpoint", info.Checkpoint)
+	}
+}
+
+// a repo in a bucket+table pair
+type RepoSummary struct {
+	Prefix   string
+	Branch   string
+	Tip      string
+	Bundles  int
+	LastPush time.Time
+	Error    string
+}
+
+// scan the table for the repos stored in a bucket
+func listRepos(bucket, table string) []RepoSummary {
+	fmt.Fprintln(os.Stderr, "scan dynamodb://"+table+"/"+bucket+"/")
+	paginator := dynamodb.NewScanPaginator(lib.DynamoDBClient(), &dynamodb.ScanInput{
+		TableName:        aws.String(table),
+		ConsistentRead:   aws.Bool(true),
+		FilterExpression: aws.String("begins_with(id, :bucket)"),
+		ExpressionAttributeValues: map[string]ddbtypes.AttributeValue{
+			":bucket": &ddbtypes.AttributeValueMemberS{Value: bucket + "/"},
+		},
+	})
+	var repos []RepoSummary
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.Background())
 		if err != nil {
 			panic(err)
 		}
-		if closeReadErr != nil {
-			panic(closeReadErr)
+		for _, item := range page.Items {
+			repo, ok := summarizeRepo(bucket, item)
+			if ok {
+				repos = append(repos, repo)
+			}
+		}
+	}
+	sort.Slice(repos, func(i, j int) bool { return repos[i].Prefix < repos[j].Prefix })
+	return repos
+}
+
+// summarize one repo from its lock item. unreadable metadata is
+// reported in the summary instead of stopping the listing. returns false
+// for items without bundles, like a remote that was deleted.
+func summarizeRepo(bucket string, item map[string]ddbtypes.AttributeValue) (repo RepoSummary, ok bool) {
+	id, _ := item["id"].(*ddbtypes.AttributeValueMemberS)
+	if id != nil {
+		repo.Prefix = strings.TrimPrefix(id.Value, bucket+"/")
+	}
+	defer func() {
+		if err := recover(); err != nil {
+			repo.Error = fmt.Sprint(err)
+			ok = true
 		}
-		if closeWriteErr != nil {
-			panic(closeWriteErr)
+	}()
+	var repoMeta RepoMeta
+	err := attributevalue.UnmarshalMap(item, &repoMeta)
+	if err != nil {
+		panic(err)
+	}
+	if repoMeta.BundlesS3Key == "" {
+		return repo, false
+	}
+	repo.Branch = repoMeta.Branch
+	bundles := getBundles(bucket, repoMeta.BundlesS3Key)
+	repo.Bundles = len(bundles)
+	if len(bundles) > 0 {
+		repo.Tip = hashEnd(bundles[len(bundles)-1].Name)
+	}
+	// the bundles metadata is rewritten by every push
+	out, err := lib.S3Client().HeadObject(context.Background(), &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(repoMeta.BundlesS3Key),
+	})
+	if err != nil {
+		panic(err)
+	}
+	repo.LastPush = *out.LastModified
+	return repo, true
+}
+
+// print the repos stored in a bucket+table pair
+func ls(remotePath string) {
+	if !strings.Contains(strings.TrimPrefix(remotePath, "aws://"), "/") {
+		remotePath += "/"
+	}
+	bucket, table, _ := parseRemote(remotePath)
+	failed := 0
+	for _, repo := range listRepos(bucket, table) {
+		if repo.Error != "" {
+			fmt.Println(repo.Prefix, "error", repo.Error)
+			failed++
+			continue
 		}
+		fmt.Println(repo.Prefix, repo.Branch, repo.Tip, repo.Bundles, repo.LastPush.UTC().Format(time.RFC3339))
+	}
+	if failed > 0 {
+		fmt.Fprintln(os.Stderr, "ls could not read", failed, "repos")
+		os.Exit(1)
+	}
+}
 
-		// import
-		fmt.Fprintln(os.Stderr, "git unbundle:", path.Base(bundleFileEncrypted))
-		cmd := exec.Command("git", "bundle", "unbundle", bundleFile)
-		var bundleStdout bytes.Buffer
-		var bundleStderr bytes.Buffer
-		cmd.Stderr = &bundleStderr
-		cmd.Stdout = &bundleStdout
-		err = cmd.Run()
+// print the bundles of a remote, newest first
+func bundleLog(remotePath string) {
+	bucket, table, prefix := parseRemote(remotePath)
+	fmt.Fprintln(os.Stderr, "get dynamodb://"+table+"/"+bucket+"/"+prefix)
+	repoMeta, err := dynamolock.Read[RepoMeta](context.Background(), table, bucket+"/"+prefix)
+	if err != nil {
+		panic(err)
+	}
+	if repoMeta == nil || repoMeta.Branch == "" || repoMeta.BundlesS3Key == "" {
+		panic("remote not found: " + remotePath)
+	}
+	bundles := getBundles(bucket, repoMeta.BundlesS3Key)
+	for i := len(bundles) - 1; i >= 0; i-- {
+		fmt.Println(bundles[i].Name, bundles[i].Size)
+	}
+}
+
+// decrypt the whole chain of a remote into a bare repo, written to one
+// standard git bundle when out is set, and kept at bare when it is set
+func export(remotePath, out, bare string) {
+	bucket, table, prefix := parseRemote(remotePath)
+	fmt.Fprintln(os.Stderr, "get dynamodb://"+table+"/"+bucket+"/"+prefix)
+	repoMeta, err := dynamolock.Read[RepoMeta](context.Background(), table, bucket+"/"+prefix)
+	if err != nil {
+		panic(err)
+	}
+	if repoMeta == nil || repoMeta.Branch == "" || repoMeta.BundlesS3Key == "" {
+		panic("remote not found: " + remotePath)
+	}
+	bundles := getBundles(bucket, repoMeta.BundlesS3Key)
+	if len(bundles) == 0 {
+		panic("remote has no bundles: " + remotePath)
+	}
+	if out != "" {
+		out, err = filepath.Abs(out)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, bundleStderr.String())
-			fmt.Fprintln(os.Stderr, bundleStdout.String())
 			panic(err)
 		}
+		_, err = os.Stat(out)
+		if err == nil {
+			panic("output already exists: " + out)
+		}
+	}
 
-		// remove
-		err = os.Remove(bundleFileEncrypted)
+	tempdir, err := os.MkdirTemp("/tmp", tempdirPrefix)
+	if err != nil {
+		panic(err)
+	}
+	defer func() { _ = os.RemoveAll(tempdir) }()
+	gitDir := path.Join(tempdir, "repo.git")
+	if bare != "" {
+		gitDir = bare
+		entries, err := os.ReadDir(gitDir)
+		if err == nil && len(entries) > 0 {
+			panic("bare repo directory is not empty: " + gitDir)
+		}
+	}
+	objectFormat := "sha1"
+	if len(hashEnd(bundles[0].Name)) == 64 {
+		objectFormat = "sha256"
+	}
+	gitOut("init", "--quiet", "--bare", "--object-format="+objectFormat, gitDir)
+
+	// unbundle in order so prerequisites are satisfied
+	for _, bundle := range bundles {
+		bundleFileEncrypted := path.Join(tempdir, bundle.Name)
+		bundleFile := bundleFileEncrypted + ".decrypted"
+		getBundle(bucket, prefix, bundle, bundleFileEncrypted)
+		decryptFile(bundleSecretKey(remotePath, bundle), bundleFileEncrypted, bundleFile)
+		fmt.Fprintln(os.Stderr, "git unbundle:", bundle.Name)
+		gitBundle(gitDir, "unbundle", bundleFile)
+		err := os.Remove(bundleFileEncrypted)
 		if err != nil {
 			panic(err)
 		}
@@ -514,72 +3251,169 @@ func fetch(table, bucket, prefix, remotePath, command string) {
 		if err != nil {
 			panic(err)
 		}
-
 	}
+	branchRef := "refs/heads/" + repoMeta.Branch
+	gitOut("-C", gitDir, "update-ref", branchRef, hashEnd(last(bundles).Name))
+	gitOut("-C", gitDir, "symbolic-ref", "HEAD", branchRef)
 
-	// communicate with git caller
-	fmt.Println("")
+	if out != "" {
+		fmt.Fprintln(os.Stderr, "git bundle:", out)
+		gitBundle(gitDir, "create", out, "HEAD", branchRef)
+		fmt.Println("exported", remotePath, "to", out)
+	}
+	if bare != "" {
+		fmt.Println("exported", remotePath, "to", bare)
+	}
 }
 
-// git helper list
-func list(table, bucket, prefix string) {
+// verify a remote end to end without touching the local repo, returning
+// the number of problems found
+func fsck(remotePath string, verify bool) int {
+	bucket, table, prefix := parseRemote(remotePath)
+	report := &fsckReport{}
 
+	// read metadata
 	fmt.Fprintln(os.Stderr, "get dynamodb://"+table+"/"+bucket+"/"+prefix)
 	repoMeta, err := dynamolock.Read[RepoMeta](context.Background(), table, bucket+"/"+prefix)
 	if err != nil {
 		panic(err)
 	}
-	if repoMeta == nil {
-		repoMeta = &RepoMeta{}
-	} else {
-		fmt.Fprintln(os.Stderr, "got meta:", repoMeta)
+	if repoMeta == nil || repoMeta.Branch == "" || repoMeta.BundlesS3Key == "" {
+		panic("remote not found: " + remotePath)
+	}
+	fmt.Println("branch", repoMeta.Branch)
+
+	// bundles metadata must exist and parse
+	var bundles []Bundle
+	report.check("bundles metadata s3://"+bucket+"/"+repoMeta.BundlesS3Key, func() {
+		bundles = getBundles(bucket, repoMeta.BundlesS3Key)
+	})
+	if bundles == nil {
+		return report.problems
+	}
+
+	// every bundle must exist with the recorded size
+	objects := map[string]s3types.Object{}
+	for _, object := range listObjects(bucket, prefix+"/") {
+		objects[*object.Key] = object
+	}
+	for _, bundle := range bundles {
+		key := prefix + "/" + bundle.Name
+		report.check("bundle exists s3://"+bucket+"/"+key, func() {
+			object, ok := objects[key]
+			if !ok {
+				panic("bundle is missing")
+			}
+			if bundle.Sha256 != "" && *object.Size != bundle.Size {
+				panic(fmt.Sprintf("bundle size mismatch: expected %d bytes, got %d", bundle.Size, *object.Size))
+			}
+		})
+	}
+
+	// the checkpoint must exist and be a commit in the chain
+	if repoMeta.Checkpoint != nil {
+		key := prefix + "/" + repoMeta.Checkpoint.bundle().Name
+		report.check("checkpoint exists s3://"+bucket+"/"+key, func() {
+			object, ok := objects[key]
+			if !ok {
+				panic("checkpoint is missing")
+			}
+			if *object.Size != repoMeta.Checkpoint.Size {
+				panic(fmt.Sprintf("checkpoint size mismatch: expected %d bytes, got %d", repoMeta.Checkpoint.Size, *object.Size))
+			}
+			for _, bundle := range bundles {
+				if hashEnd(bundle.Name) == repoMeta.Checkpoint.Hash {
+					return
+				}
+			}
+			panic("checkpoint is not the end of any bundle")
+		})
+	}
+
+	// the chain must start at the zero hash and each bundle must start
+	// where the previous one ended
+	report.check("bundle chain", func() {
+		start := zeroHash
+		if len(hashEnd(bundles[0].Name)) == 64 {
+			start = zeroHash256
+		}
+		for _, bundle := range bundles {
+			parts := bundleNameParts(bundle.Name)
+			if parts[0] != start {
+				panic(fmt.Sprintf("chain is broken at %s: expected start %s", bundle.Name, start))
+			}
+			start = parts[1]
+		}
+	})
+
+	// optionally download, decrypt, and verify each bundle in order
+	// against a scratch repo so prerequisites are satisfied
+	if verify {
+		tempdir, err := os.MkdirTemp("/tmp", tempdirPrefix)
+		if err != nil {
+			panic(err)
+		}
+		defer func() { _ = os.RemoveAll(tempdir) }()
+		gitDir := path.Join(tempdir, "repo.git")
+		objectFormat := "sha1"
+		if len(hashEnd(bundles[0].Name)) == 64 {
+			objectFormat = "sha256"
+		}
+		cmd := exec.Command("git", "init", "--quiet", "--bare", "--object-format="+objectFormat, gitDir)
+		cmd.Stderr = os.Stderr
+		err = cmd.Run()
+		if err != nil {
+			panic(err)
+		}
+		for _, bundle := range bundles {
+			ok := report.check("bundle verify "+bundle.Name, func() {
+				bundleFileEncrypted := path.Join(tempdir, bundle.Name)
+				bundleFile := bundleFileEncrypted + ".decrypted"
+				defer func() {
+					_ = os.Remove(bundleFileEncrypted)
+					_ = os.Remove(bundleFile)
+				}()
+				getBundle(bucket, prefix, bundle, bundleFileEncrypted)
+				decryptFile(bundleSecretKey(remotePath, bundle), bundleFileEncrypted, bundleFile)
+				gitBundle(gitDir, "verify", bundleFile)
+				gitBundle(gitDir, "unbundle", bundleFile)
+			})
+			if !ok {
+				break // later bundles need this one as a prerequisite
+			}
+		}
 	}
 
-	// find remote branch, falling back to default branch
-	branch := defaultBranch
-	if repoMeta != nil && repoMeta.Branch != "" {
-		branch = repoMeta.Branch
+	// objects in the prefix not reachable from metadata are orphans.
+	// they are harmless but can be removed with --gc.
+	for _, object := range orphans(prefix, repoMeta, bundles, objects) {
+		fmt.Println("orphan s3://" + bucket + "/" + *object.Key)
 	}
 
-	// fetch remote bundles metadata
-	var remoteBundles []string
-	if repoMeta != nil && repoMeta.BundlesS3Key != "" {
-		remoteBundles = getBundles(bucket, repoMeta.BundlesS3Key)
+	if report.problems > 0 {
+		fmt.Fprintln(os.Stderr, "fsck found", report.problems, "problems:", remotePath)
 	}
+	return report.problems
+}
 
-	// communicate with git caller
-	if len(remoteBundles) > 0 {
-		// if remote bundles exist, print the latest hash
-		hash := hashEnd(last(remoteBundles))
-		if len(hash) == 64 {
-			fmt.Println(":object-format sha256")
-		}
-		fmt.Println(hash, "refs/heads/"+branch)
-		fmt.Println("@refs/heads/"+branch, "HEAD")
-	} else {
-		// else print the zero hash
-		var stdout bytes.Buffer
-		cmd := exec.Command("git", "config", "extensions.objectformat")
-		cmd.Stdout = &stdout
-		err := cmd.Run()
-		objectFormat := ""
-		if err == nil {
-			objectFormat = strings.Trim(stdout.String(), "\n")
-		}
-		if objectFormat == "sha256" {
-			fmt.Println(zeroHash256, "HEAD")
-		} else {
-			fmt.Println(zeroHash, "HEAD")
+// "aws://bucket+table/prefix?kms=alias/key" => kms=alias/key
+func remoteOptions(remotePath string) url.Values {
+	_, query, _ := strings.Cut(remotePath, "?")
+	options, err := url.ParseQuery(query)
+	if err != nil {
+		panic(fmt.Errorf("invalid remote options %s: %w", remotePath, err))
+	}
+	for name := range options {
+		if name != "kms" {
+			panic("unknown remote option: " + name)
 		}
 	}
-	fmt.Println("")
+	return options
 }
 
-func gitHelper() {
-
-	// parse remote path to get bucket and prefix
-	// remoteName := os.Args[1]
-	remotePath := os.Args[2]
+// "aws://bucket+table/prefix?options" => bucket, table, prefix
+func parseRemote(remotePath string) (string, string, string) {
+	remotePath, _, _ = strings.Cut(remotePath, "?")
 	if !strings.HasPrefix(remotePath, "aws://") {
 		panic("missing prefix aws:// " + remotePath)
 	}
@@ -592,21 +3426,15 @@ func gitHelper() {
 	if err != nil {
 		panic(err)
 	}
+	return bucket, table, prefix
+}
 
-	// cd to git root
-	gitDir := os.Getenv("GIT_DIR")
-	if gitDir == "" {
-		panic("GIT_DIR")
-	}
-	err = os.Chdir(path.Dir(gitDir))
-	if err != nil {
-		panic(err)
-	}
-
+// create the bucket and table of a remote if needed and ensure=y
+func ensureBucketAndTable(bucket, table string) {
 	ensure := os.Getenv("ensure") == "y"
 
 	// create bucket if needed
-	_, err = lib.S3BucketRegion(bucket)
+	_, err := lib.S3BucketRegion(bucket)
 	if err != nil {
 		if !ensure {
 			fmt.Fprintln(os.Stderr, "fatal: bucket did not exist and ensure=y env var not provided:", bucket)
@@ -648,8 +3476,28 @@ func gitHelper() {
 		}
 		fmt.Fprintln(os.Stderr, "created private dynamodb table:", table)
 	}
+}
+
+func gitHelper() {
+
+	// parse remote path to get bucket and prefix
+	remotePath := os.Args[2]
+	bucket, table, prefix := parseRemote(remotePath)
+
+	// cd to git root
+	gitDir := os.Getenv("GIT_DIR")
+	if gitDir == "" {
+		panic("GIT_DIR")
+	}
+	err := os.Chdir(path.Dir(gitDir))
+	if err != nil {
+		panic(err)
+	}
+
+	ensureBucketAndTable(bucket, table)
 
 	// read stdin and invoke git remote helpers
+	var options helperOptions
 	r := bufio.NewReader(os.Stdin)
 	for {
 
@@ -669,9 +3517,12 @@ func gitHelper() {
 		} else if command == "list for-push" || command == "list" {
 			list(table, bucket, prefix)
 		} else if strings.HasPrefix(command, "push ") {
-			push(table, bucket, prefix, command)
+			push(table, bucket, prefix, remotePath, command)
+			pushMirrors(os.Args[1], remotePath)
+		} else if strings.HasPrefix(command, "option ") {
+			option(&options, command)
 		} else if strings.HasPrefix(command, "fetch ") {
-			fetch(table, bucket, prefix, remotePath, command)
+			fetch(table, bucket, prefix, remotePath, command, options.depth)
 		} else if command == "" {
 			os.Exit(0)
 		} else {
@@ -682,73 +3533,617 @@ func gitHelper() {
 
 }
 
+// a subcommand. aliases are the flag spellings from before there were
+// subcommands.
+type command struct {
+	name    string
+	aliases []string
+	args    string
+	summary string
+	run     func(flags *flag.FlagSet, args []string)
+}
+
+func commands() []command {
+	return []command{
+		{"keygen", []string{"-k", "--keygen"}, "[--out ~/.config/git-remote-aws/key]", "generate a keypair, printed as export statements or written to a passphrase encrypted key file", func(flags *flag.FlagSet, args []string) {
+			out := flags.String("out", "", "write a passphrase encrypted key file instead of printing the secret key, for example "+keyFilePath())
+			parseFlags(flags, args, 0)
+			keygen(*out)
+		}},
+		{"encrypt", []string{"-e", "--encrypt"}, "[--publickeys .publickeys] [--recipient key]... [--in file|dir] [--out file]", "encrypt stdin or a file or directory, to the local public key or to other recipients", func(flags *flag.FlagSet, args []string) {
+			publicKeysFile := flags.String("publickeys", "", "encrypt to every entry of this .publickeys file")
+			var recipientLines stringsFlag
+			flags.Var(&recipientLines, "recipient", "encrypt to this hex, ssh-ed25519, or age1 public key, can be repeated")
+			in := flags.String("in", "", "read this file, or directory as a tar stream, instead of stdin")
+			out := flags.String("out", "", "write this file instead of stdout")
+			parseFlags(flags, args, 0)
+			encrypt(*publicKeysFile, recipientLines, *in, *out)
+		}},
+		{"decrypt", []string{"-d", "--decrypt"}, "[--in file] [--out file | --untar dir]", "decrypt stdin or a file with the local secret key", func(flags *flag.FlagSet, args []string) {
+			in := flags.String("in", "", "read this file instead of stdin")
+			out := flags.String("out", "", "write this file instead of stdout")
+			untar := flags.String("untar", "", "extract a tar stream into this directory")
+			parseFlags(flags, args, 0)
+			if *out != "" && *untar != "" {
+				flags.Usage()
+				os.Exit(1)
+			}
+			decrypt(*in, *out, *untar)
+		}},
+		{"whoami", []string{"--whoami"}, "", "show which .publickeys entry matches the local public key", func(flags *flag.FlagSet, args []string) {
+			parseFlags(flags, args, 0)
+			whoami()
+		}},
+		{"recipients", []string{"--recipients"}, "", "list the entries of .publickeys", func(flags *flag.FlagSet, args []string) {
+			parseFlags(flags, args, 0)
+			listRecipients()
+		}},
+		{"info", nil, "[--json] aws://bucket+table/repo", "show the state of a remote", func(flags *flag.FlagSet, args []string) {
+			asJSON := flags.Bool("json", false, "print json")
+			args = parseFlags(flags, args, 1)
+			printInfo(args[0], *asJSON)
+		}},
+		{"ls", nil, "aws://bucket+table/", "list the repos in a bucket, with branch, tip, bundle count, and last push time", func(flags *flag.FlagSet, args []string) {
+			args = parseFlags(flags, args, 1)
+			ls(args[0])
+		}},
+		{"rm", nil, "[--yes] [--archive] aws://bucket+table/repo", "delete a remote, or archive it to glacier and make it read-only", func(flags *flag.FlagSet, args []string) {
+			yes := flags.Bool("yes", false, "do not ask for confirmation")
+			archive := flags.Bool("archive", false, "move objects to glacier instant retrieval and mark the remote read-only instead of deleting")
+			args = parseFlags(flags, args, 1)
+			rm(args[0], *yes, *archive)
+		}},
+		{"freeze", nil, "aws://bucket+table/repo", "make a remote read-only, push is refused while list and fetch keep working", func(flags *flag.FlagSet, args []string) {
+			args = parseFlags(flags, args, 1)
+			freeze(args[0], true)
+		}},
+		{"unfreeze", nil, "aws://bucket+table/repo", "make a frozen remote writable again", func(flags *flag.FlagSet, args []string) {
+			args = parseFlags(flags, args, 1)
+			freeze(args[0], false)
+		}},
+		{"mirror", nil, "src-url dst-url", "copy the bundles a destination remote is missing from a source remote, without decrypting", func(flags *flag.FlagSet, args []string) {
+			args = parseFlags(flags, args, 2)
+			mirror(args[0], args[1])
+		}},
+		{"import", nil, "[--branch current] [--max-size 256M] aws://bucket+table/repo", "push the history of a local branch as bundles of bounded size, resuming an interrupted import", func(flags *flag.FlagSet, args []string) {
+			branch := flags.String("branch", "", "the branch to import, by default the current branch")
+			maxSize := flags.String("max-size", "256M", "the largest bundle to create, by size of objects on disk, with K, M, or G suffix")
+			args = parseFlags(flags, args, 1)
+			importRepo(args[0], *branch, parseSize(*maxSize))
+		}},
+		{"export", nil, "[--bare dir] aws://bucket+table/repo [out.bundle]", "decrypt a remote into one standard git bundle or a bare repo", func(flags *flag.FlagSet, args []string) {
+			bare := flags.String("bare", "", "write a bare repo to this directory")
+			err := flags.Parse(args)
+			if err != nil {
+				panic(err)
+			}
+			if flags.NArg() < 1 || flags.NArg() > 2 || (flags.NArg() == 1 && *bare == "") {
+				flags.Usage()
+				os.Exit(1)
+			}
+			export(flags.Arg(0), flags.Arg(1), *bare)
+		}},
+		{"checkpoint", nil, "aws://bucket+table/repo", "put a shallow snapshot of the remote tip, from a local clone, used by fetch with a depth", func(flags *flag.FlagSet, args []string) {
+			args = parseFlags(flags, args, 1)
+			checkpoint(args[0])
+		}},
+		{"log", nil, "aws://bucket+table/repo", "list the bundles of a remote, newest first", func(flags *flag.FlagSet, args []string) {
+			args = parseFlags(flags, args, 1)
+			bundleLog(args[0])
+		}},
+		{"fsck", []string{"--fsck"}, "[--verify] aws://bucket+table/repo", "check that a remote is consistent", func(flags *flag.FlagSet, args []string) {
+			verify := flags.Bool("verify", false, "download, decrypt, and git bundle verify every bundle")
+			args = parseFlags(flags, args, 1)
+			// exit once fsck returns, so its scratch repo of decrypted
+			// objects is removed
+			if fsck(args[0], *verify) > 0 {
+				os.Exit(1)
+			}
+		}},
+		{"gc", []string{"--gc"}, "[--dry-run] [--grace 24h] aws://bucket+table/repo", "delete objects left behind by failed pushes", func(flags *flag.FlagSet, args []string) {
+			dryRun := flags.Bool("dry-run", false, "report orphans without deleting them")
+			grace := flags.Duration("grace", 24*time.Hour, "only delete orphans older than this")
+			args = parseFlags(flags, args, 1)
+			gc(args[0], *grace, *dryRun)
+		}},
+		{"agent", []string{"--agent"}, "[--ttl 1h]", "hold secret keys in memory so they are resolved once", func(flags *flag.FlagSet, args []string) {
+			ttl := flags.Duration("ttl", time.Hour, "how long to hold each secret key")
+			parseFlags(flags, args, 0)
+			agent(*ttl)
+		}},
+	}
+}
+
+// parse flags and require exactly nargs positional arguments
+func parseFlags(flags *flag.FlagSet, args []string, nargs int) []string {
+	err := flags.Parse(args)
+	if err != nil {
+		panic(err)
+	}
+	if flags.NArg() != nargs {
+		flags.Usage()
+		os.Exit(1)
+	}
+	return flags.Args()
+}
+
+func findCommand(name string) (command, bool) {
+	for _, cmd := range commands() {
+		if cmd.name == name || slices.Contains(cmd.aliases, name) {
+			return cmd, true
+		}
+	}
+	return command{}, false
+}
+
+// git runs remote helpers as git-remote-aws <remote> <url> from a repo.
+// the remote can have any name, including a command name, so commands
+// run from git aliases and hooks, which also set GIT_DIR, need it unset.
+func isGitHelper(args []string) bool {
+	return len(args) == 3 && strings.HasPrefix(args[2], "aws://") && os.Getenv("GIT_DIR") != ""
+}
+
 func usage() {
-	fmt.Fprintln(os.Stderr, "usage: git-remote-aws --keygen")
-	fmt.Println()
-	fmt.Fprintln(os.Stderr, "example: eval $(git-remote-aws --keygen)")
-	fmt.Println()
-	fmt.Fprintln(os.Stderr, "example: echo hello | git-remote-aws --encrypt > ciphertext")
-	fmt.Println()
-	fmt.Fprintln(os.Stderr, "example: cat ciphertext | git-remote-aws --decrypt")
-	os.Exit(1)
+	fmt.Fprintln(os.Stderr, "usage: git-remote-aws <command> [flags]")
+	fmt.Fprintln(os.Stderr)
+	for _, cmd := range commands() {
+		fmt.Fprintf(os.Stderr, "  %-11s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "run git-remote-aws <command> --help for the flags of a command")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "example: eval $(git-remote-aws keygen)")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "example: echo hello | git-remote-aws encrypt > ciphertext")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "example: cat ciphertext | git-remote-aws decrypt")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "example: git-remote-aws encrypt --publickeys .publickeys --in secrets/ --out secrets.encrypted")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "example: git-remote-aws decrypt --in secrets.encrypted --untar secrets/")
 }
 
-func publicKeys() [][]byte {
-	data, err := os.ReadFile(".publickeys")
+// an entry in .publickeys
+type Recipient struct {
+	Name      string
+	Type      string
+	PublicKey []byte
+	Line      int
+}
+
+// parse a .publickeys entry, which is a key optionally preceded by a name
+// or followed by a name such as user@host. keys are hex, ssh-ed25519, or
+// age1. anything after a # is a comment.
+func parseRecipient(line string) (Recipient, error) {
+	fields := strings.Fields(line)
+	for i, field := range fields {
+		if strings.HasPrefix(field, "#") {
+			fields = fields[:i]
+			break
+		}
+	}
+	var recipient Recipient
+	if len(fields) == 0 {
+		return recipient, nil
+	}
+	isKey := func(field string) bool {
+		_, err := hex.DecodeString(field)
+		return strings.HasPrefix(field, "ssh-") || strings.HasPrefix(field, "age1") || (err == nil && len(field) == 2*curve25519.PointSize)
+	}
+	if !isKey(fields[0]) && len(fields) > 1 {
+		recipient.Name = fields[0]
+		fields = fields[1:]
+	}
+	keyFields := 1
+	if strings.HasPrefix(fields[0], "ssh-") {
+		keyFields = 2
+	}
+	if len(fields) < keyFields {
+		return recipient, fmt.Errorf("ssh key is missing its base64 key")
+	}
+	if recipient.Name == "" {
+		recipient.Name = strings.Join(fields[keyFields:], " ")
+	}
+	var err error
+	recipient.PublicKey, err = parsePublicKey(strings.Join(fields[:keyFields], " "))
+	if err != nil {
+		return recipient, err
+	}
+	switch {
+	case strings.HasPrefix(fields[0], "ssh-"):
+		recipient.Type = fields[0]
+	case strings.HasPrefix(fields[0], "age1"):
+		recipient.Type = "age"
+	default:
+		recipient.Type = "hex"
+	}
+	return recipient, nil
+}
+
+func recipients() []Recipient {
+	return readRecipients(".publickeys")
+}
+
+func readRecipients(file string) []Recipient {
+	data, err := os.ReadFile(file)
 	if err != nil {
 		panic(err)
 	}
+	var recipients []Recipient
+	for i, line := range strings.Split(string(data), "\n") {
+		recipient, err := parseRecipient(line)
+		if err != nil {
+			panic(fmt.Sprintf("malformed %s line %d: %s", file, i+1, err))
+		}
+		if recipient.PublicKey == nil {
+			continue
+		}
+		recipient.Line = i + 1
+		recipients = append(recipients, recipient)
+	}
+	return recipients
+}
+
+func publicKeys() [][]byte {
+	var publicKeys [][]byte
+	for _, recipient := range recipients() {
+		publicKeys = append(publicKeys, recipient.PublicKey)
+	}
+	return publicKeys
+}
+
+func (r Recipient) String() string {
+	name := r.Name
+	if name == "" {
+		name = "-"
+	}
+	return fmt.Sprintf(".publickeys:%d %s %s %s", r.Line, hex.EncodeToString(r.PublicKey), r.Type, name)
+}
+
+// list the entries of .publickeys
+func listRecipients() {
+	for _, recipient := range recipients() {
+		fmt.Println(recipient)
+	}
+}
+
+// show which .publickeys entry matches the local public key
+func whoami() {
+	publicKey := publicKey()[0]
+	if os.Getenv("GIT_REMOTE_AWS_PUBLICKEY") != "" && hasSecretKey() {
+		warnPublicKeyMismatch(publicKey, derivePublicKey(secretKey("")))
+	}
+	for _, recipient := range recipients() {
+		if bytes.Equal(recipient.PublicKey, publicKey) {
+			fmt.Println(recipient)
+			return
+		}
+	}
+	fmt.Fprintln(os.Stderr, "public key", hex.EncodeToString(publicKey), "is not in .publickeys")
+	os.Exit(1)
+}
+
+// a flag that can be repeated
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// the public keys to encrypt to: entries of a .publickeys file and
+// explicit recipients, or the local public key when neither is given
+func encryptRecipients(publicKeysFile string, recipientLines []string) [][]byte {
 	var publicKeys [][]byte
-	for _, line := range bytes.Split(data, []byte("\n")) {
-		if len(line) > 0 {
-			line, err := hex.DecodeString(string(line))
+	if publicKeysFile != "" {
+		for _, recipient := range readRecipients(publicKeysFile) {
+			publicKeys = append(publicKeys, recipient.PublicKey)
+		}
+	}
+	for _, line := range recipientLines {
+		recipient, err := parseRecipient(line)
+		if err == nil && recipient.PublicKey == nil {
+			err = fmt.Errorf("empty recipient")
+		}
+		if err != nil {
+			panic(fmt.Sprintf("malformed --recipient %q: %s", line, err))
+		}
+		publicKeys = append(publicKeys, recipient.PublicKey)
+	}
+	if publicKeysFile == "" && len(recipientLines) == 0 {
+		publicKeys = publicKey()
+	}
+	if len(publicKeys) == 0 {
+		panic("no recipients to encrypt to")
+	}
+	return publicKeys
+}
+
+// open the input, stdin when empty or -. directories are read as a tar
+// stream of their contents.
+func openInput(in string) io.ReadCloser {
+	if in == "" || in == "-" {
+		return io.NopCloser(os.Stdin)
+	}
+	info, err := os.Stat(in)
+	if err != nil {
+		panic(err)
+	}
+	if !info.IsDir() {
+		r, err := os.Open(in)
+		if err != nil {
+			panic(err)
+		}
+		return r
+	}
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(writeTar(in, w))
+	}()
+	return r
+}
+
+// create the output, stdout when empty or -
+func createOutput(out string) io.WriteCloser {
+	if out == "" || out == "-" {
+		return os.Stdout
+	}
+	w, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		panic(err)
+	}
+	return w
+}
+
+// write the contents of dir as a tar stream with paths relative to dir
+func writeTar(dir string, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	err := filepath.WalkDir(dir, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		link := ""
+		if info.Mode()&fs.ModeSymlink != 0 {
+			link, err = os.Readlink(file)
+			if err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(name)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		err = tw.WriteHeader(header)
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, f)
+		closeErr := f.Close()
+		if err != nil {
+			return err
+		}
+		return closeErr
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// extract a tar stream into dir, refusing paths and symlinks that
+// escape it. writes go through os.Root, so they never follow a symlink
+// out of dir.
+func extractTar(r io.Reader, dir string) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		panic(err)
+	}
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		panic(err)
+	}
+	defer func() { _ = root.Close() }()
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			panic(err)
+		}
+		name := filepath.Clean(filepath.FromSlash(header.Name))
+		if !filepath.IsLocal(name) {
+			panic("tar entry escapes the output directory: " + header.Name)
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = root.MkdirAll(name, fs.FileMode(header.Mode).Perm()|0o700)
+		case tar.TypeReg:
+			err = root.MkdirAll(filepath.Dir(name), 0o755)
+			if err != nil {
+				panic(err)
+			}
+			var f *os.File
+			f, err = root.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fs.FileMode(header.Mode).Perm())
 			if err != nil {
 				panic(err)
 			}
-			pk, _, err := libsodium.BoxKeypair()
+			_, err = io.Copy(f, tr)
+			closeErr := f.Close()
+			if err == nil {
+				err = closeErr
+			}
+		case tar.TypeSymlink:
+			err = root.MkdirAll(filepath.Dir(name), 0o755)
 			if err != nil {
 				panic(err)
 			}
-			if len(line) != len(pk) {
-				panic(fmt.Sprintf("malformed .publickeys file: %d != %d", len(line), len(pk)))
+			target := filepath.FromSlash(header.Linkname)
+			if !symlinkInside(dir, name, target) {
+				panic("tar symlink escapes the output directory: " + header.Name + " -> " + header.Linkname)
 			}
-			publicKeys = append(publicKeys, line)
+			err = root.Symlink(target, name)
+		default:
+			fmt.Fprintln(os.Stderr, "skip unsupported tar entry:", header.Name)
+		}
+		if err != nil {
+			panic(err)
 		}
 	}
-	return publicKeys
 }
 
-func encrypt() {
-	err := libsodium.StreamEncryptRecipients(publicKey(), os.Stdin, os.Stdout)
+// whether a symlink at name in dir resolves inside dir, following the
+// symlinks already extracted. after a component that does not exist
+// yet, the target cannot climb with .., since a later entry could make
+// that component a symlink.
+func symlinkInside(dir, name, target string) bool {
+	if filepath.IsAbs(target) {
+		return false
+	}
+	separator := string(filepath.Separator)
+	pending := append(strings.Split(filepath.Dir(name), separator), strings.Split(target, separator)...)
+	var resolved []string
+	missing := false
+	hops := 0
+	for len(pending) > 0 {
+		part := pending[0]
+		pending = pending[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if missing || len(resolved) == 0 {
+				return false
+			}
+			resolved = resolved[:len(resolved)-1]
+			continue
+		}
+		resolved = append(resolved, part)
+		if missing {
+			continue
+		}
+		file := filepath.Join(append([]string{dir}, resolved...)...)
+		info, err := os.Lstat(file)
+		if os.IsNotExist(err) {
+			missing = true
+			continue
+		}
+		if err != nil {
+			return false
+		}
+		if info.Mode().Type() == os.ModeSymlink {
+			hops++
+			link, err := os.Readlink(file)
+			if err != nil || hops > 40 || filepath.IsAbs(link) {
+				return false
+			}
+			resolved = resolved[:len(resolved)-1]
+			pending = append(strings.Split(link, separator), pending...)
+		}
+	}
+	return true
+}
+
+func encrypt(publicKeysFile string, recipientLines []string, in, out string) {
+	publicKeys := encryptRecipients(publicKeysFile, recipientLines)
+	r := openInput(in)
+	w := createOutput(out)
+	err := libsodium.StreamEncryptRecipients(publicKeys, r, w)
+	closeReadErr := r.Close()
+	closeWriteErr := w.Close()
 	if err != nil {
 		panic(err)
 	}
+	if closeReadErr != nil {
+		panic(closeReadErr)
+	}
+	if closeWriteErr != nil {
+		panic(closeWriteErr)
+	}
 }
 
-func decrypt() {
-	err := libsodium.StreamDecryptRecipients(secretKey(""), os.Stdin, os.Stdout)
+func decrypt(in, out, untar string) {
+	r := openInput(in)
+	defer func() { _ = r.Close() }()
+	if untar != "" {
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(libsodium.StreamDecryptRecipients(secretKey(""), r, pw))
+		}()
+		extractTar(pr, untar)
+		_, err := io.Copy(io.Discard, pr)
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
+	w := createOutput(out)
+	err := libsodium.StreamDecryptRecipients(secretKey(""), r, w)
+	closeErr := w.Close()
 	if err != nil {
 		panic(err)
 	}
+	if closeErr != nil {
+		panic(closeErr)
+	}
 }
 
 func main() {
 	libsodium.Init()
+	if isGitHelper(os.Args) {
+		gitHelper()
+		return
+	}
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(1)
+	}
 	switch os.Args[1] {
-	case "-h", "--help":
+	case "help", "-h", "--help":
 		usage()
-	case "-e", "--encrypt":
-		encrypt()
-	case "-d", "--decrypt":
-		decrypt()
-	case "-k", "--keygen":
-		pk, sk, err := libsodium.BoxKeypair()
-		if err != nil {
-			panic(err)
-		}
-		fmt.Printf("export GIT_REMOTE_AWS_PUBLICKEY=%s\n", hex.EncodeToString(pk))
-		fmt.Printf("export GIT_REMOTE_AWS_SECRETKEY=%s\n", hex.EncodeToString(sk))
-	default:
-		gitHelper()
+		return
+	}
+	cmd, ok := findCommand(os.Args[1])
+	if !ok {
+		fmt.Fprintln(os.Stderr, "unknown command:", os.Args[1])
+		fmt.Fprintln(os.Stderr)
+		usage()
+		os.Exit(1)
+	}
+	flags := flag.NewFlagSet(cmd.name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, strings.TrimSpace("usage: git-remote-aws "+cmd.name+" "+cmd.args))
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, cmd.summary)
+		fmt.Fprintln(os.Stderr)
+		flags.PrintDefaults()
 	}
+	cmd.run(flags, os.Args[2:])
 }
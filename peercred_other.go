@@ -0,0 +1,14 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// peer credentials are only checked on linux and darwin, so the agent
+// is refused elsewhere
+func peerUid(_ *net.UnixConn) (int, error) {
+	return 0, fmt.Errorf("agent peer credentials are not supported on this platform")
+}